@@ -38,22 +38,109 @@ type DoHServer struct {
 //
 // protector is Android's socket protector to use for all external network activity.
 //
+// preferH3 additionally builds an HTTP/3 (QUIC) transport and races it
+// against HTTP/2 for every query, falling back to (and latching onto)
+// whichever protocol actually works for this server; see [doh.NewResolver].
+//
 // listener will be notified after each DNS query succeeds or fails.
 func NewDoHServer(
-	url string, ipsStr string, protector protect.Protector, listener DoHListener,
+	url string, ipsStr string, protector protect.Protector, preferH3 bool, listener DoHListener,
+) (*DoHServer, error) {
+	ips := []string{}
+	if len(ipsStr) > 0 {
+		ips = strings.Split(ipsStr, ",")
+	}
+	dialer := protect.MakeDialer(protector)
+	t, err := doh.NewTransport(url, ips, dialer, nil, preferH3, nil, makeInternalDoHListener(listener))
+	if err != nil {
+		return nil, err
+	}
+	return &DoHServer{t}, nil
+}
+
+// NewDNSCryptServer creates a DoHServer that instead speaks DNSCrypt v2 to the
+// server identified by stamp, avoiding the server-side linkability between a
+// client's IP and its queries that plain DoH cannot prevent.
+//
+// stamp is the server's "sdns://" stamp (https://dnscrypt.info/stamps-specifications).
+//
+// protector is Android's socket protector to use for all external network activity.
+//
+// listener will be notified after each DNS query succeeds or fails.
+func NewDNSCryptServer(stamp string, protector protect.Protector, listener DoHListener) (*DoHServer, error) {
+	dialer := protect.MakeDialer(protector)
+	t, err := doh.NewDNSCryptResolver(stamp, dialer, makeInternalDoHListener(listener))
+	if err != nil {
+		return nil, err
+	}
+	return &DoHServer{t}, nil
+}
+
+// NewODoHServer creates a DoHServer that sends Oblivious DoH (RFC 9230) queries
+// through proxyURL to the target described by target, so that neither the proxy
+// nor the target alone can link a client's IP address to its queries.
+//
+// proxyURL is the URL of an independent ODoH proxy (POST-only).
+//
+// target is the ODoH target's published key configuration.
+//
+// protector is Android's socket protector to use for all external network activity.
+//
+// listener will be notified after each DNS query succeeds or fails.
+func NewODoHServer(
+	proxyURL string, target doh.ODoHTargetConfig, protector protect.Protector, listener DoHListener,
+) (*DoHServer, error) {
+	dialer := protect.MakeDialer(protector)
+	t, err := doh.NewODoHResolver(proxyURL, target, dialer, makeInternalDoHListener(listener))
+	if err != nil {
+		return nil, err
+	}
+	return &DoHServer{t}, nil
+}
+
+// NewDoHServerPool creates a DoHServer that spreads queries across several
+// DoH/DNSCrypt servers instead of just one, selecting among them by
+// measured health. See [doh.SelectionMode] for the available strategies.
+//
+// servers is a list of DoH templates (no template, POST-only) and/or
+// DNSCrypt "sdns://" stamps.
+//
+// ipsStr is an optional comma-separated list of IP addresses, used as a
+// fallback for any plain-DoH server in servers that can't be resolved to
+// working addresses. (string is required cuz gomobile doesn't support []string)
+//
+// protector is Android's socket protector to use for all external network activity.
+//
+// preferH3 is passed to every plain-DoH member exactly as in NewDoHServer.
+//
+// listener will be notified after each DNS query succeeds or fails.
+func NewDoHServerPool(
+	servers []string, ipsStr string, mode doh.SelectionMode, protector protect.Protector, preferH3 bool, listener DoHListener,
 ) (*DoHServer, error) {
 	ips := []string{}
 	if len(ipsStr) > 0 {
 		ips = strings.Split(ipsStr, ",")
 	}
 	dialer := protect.MakeDialer(protector)
-	t, err := doh.NewTransport(url, ips, dialer, nil, makeInternalDoHListener(listener))
+	t, err := doh.NewTransportPool(servers, ips, dialer, nil, preferH3, nil, makeInternalDoHListener(listener), mode)
 	if err != nil {
 		return nil, err
 	}
 	return &DoHServer{t}, nil
 }
 
+// DoHTransportStats returns the measured health of each server in the pool
+// that this DoHServer was built from, for rendering a resolver dashboard.
+// It returns nil if this DoHServer is not backed by a [doh.TransportPool],
+// i.e. it was created by a constructor other than NewDoHServerPool.
+func (s *DoHServer) DoHTransportStats() []doh.TransportStats {
+	pool, ok := s.tspt.(*doh.TransportPool)
+	if !ok {
+		return nil
+	}
+	return pool.Stats()
+}
+
 // dohQuery is used by [DoHServer].Probe.
 var dohQuery = []byte{
 	0, 0, // [0-1]   query ID
@@ -122,12 +209,13 @@ type DoHQueryStats struct {
 	summ *doh.Summary
 }
 
-func (q DoHQueryStats) GetQuery() []byte     { return q.summ.Query }
-func (q DoHQueryStats) GetResponse() []byte  { return q.summ.Response }
-func (q DoHQueryStats) GetServer() string    { return q.summ.Server }
-func (q DoHQueryStats) GetStatus() DoHStatus { return q.summ.Status }
-func (q DoHQueryStats) GetHTTPStatus() int   { return q.summ.HTTPStatus }
-func (q DoHQueryStats) GetLatency() float64  { return q.summ.Latency }
+func (q DoHQueryStats) GetQuery() []byte      { return q.summ.Query }
+func (q DoHQueryStats) GetResponse() []byte   { return q.summ.Response }
+func (q DoHQueryStats) GetServer() string     { return q.summ.Server }
+func (q DoHQueryStats) GetStatus() DoHStatus  { return q.summ.Status }
+func (q DoHQueryStats) GetHTTPStatus() int    { return q.summ.HTTPStatus }
+func (q DoHQueryStats) GetLatency() float64   { return q.summ.Latency }
+func (q DoHQueryStats) GetRaceWinner() string { return q.summ.RaceWinner }
 
 // dohListenerAdapter is an adapter for the internal [doh.Listener].
 type dohListenerAdapter struct {
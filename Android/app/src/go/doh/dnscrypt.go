@@ -0,0 +1,513 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/chacha20"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"localhost/Intra/Android/app/src/go/logging"
+)
+
+// dnscryptEsVersion identifies the crypto construction negotiated with the
+// resolver's certificate, per the DNSCrypt v2 protocol.
+type dnscryptEsVersion uint16
+
+const (
+	esVersionXSalsa20Poly1305  dnscryptEsVersion = 1
+	esVersionXChaCha20Poly1305 dnscryptEsVersion = 2
+)
+
+var (
+	clientMagic = [8]byte{'q', '6', 'f', 'n', 'v', 'W', 'j', '8'}
+
+	errBadCert     = errors.New("dnscrypt: invalid certificate")
+	errBadResponse = errors.New("dnscrypt: invalid response")
+)
+
+// dnscryptCert is the subset of a DNSCrypt certificate that the client needs
+// to encrypt queries: the negotiated construction, the server's short-term
+// public key, and the certificate's validity window.
+type dnscryptCert struct {
+	esVersion dnscryptEsVersion
+	serverPk  [32]byte
+	notBefore uint32
+	notAfter  uint32
+}
+
+func (c *dnscryptCert) valid(now time.Time) bool {
+	t := uint32(now.Unix())
+	return t >= c.notBefore && t <= c.notAfter
+}
+
+// dnscryptResolver implements [Resolver] for a DNSCrypt v2 server. Unlike DoH,
+// DNSCrypt queries never traverse HTTP: they are framed and encrypted with a
+// shared secret derived from the server's certificate, then sent directly
+// to the resolver over UDP. There is no TCP fallback.
+type dnscryptResolver struct {
+	url          string // the sdns:// stamp this resolver was built from
+	providerName string
+	serverAddr   *net.UDPAddr
+	serverPk     [32]byte // the provider's long-term public key, from the stamp
+	dialer       *net.Dialer
+	listener     Listener
+
+	certMu   sync.RWMutex
+	cert     *dnscryptCert
+	certTime time.Time
+}
+
+// NewDNSCryptResolver returns a [Resolver] that speaks DNSCrypt v2 to the
+// server identified by an `sdns://` stamp.
+//
+// `stamp` is the DNSCrypt stamp, as documented at
+// https://dnscrypt.info/stamps-specifications. `dialer` is used for all
+// network activity; `listener` receives the status of each query.
+func NewDNSCryptResolver(stamp string, dialer *net.Dialer, listener Listener) (Resolver, error) {
+	addr, providerName, serverPk, err := parseDNSCryptStamp(stamp)
+	if err != nil {
+		return nil, fmt.Errorf("dnscrypt: bad stamp: %w", err)
+	}
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	return &dnscryptResolver{
+		url:          stamp,
+		providerName: providerName,
+		serverAddr:   addr,
+		serverPk:     serverPk,
+		dialer:       dialer,
+		listener:     listener,
+	}, nil
+}
+
+// parseDNSCryptStamp decodes the "sdns://" prefixed, unpadded-base64url
+// stamp into the fields needed to contact the resolver and verify its
+// certificate. This implements the subset of the format (protocol 0x02,
+// DNSCrypt) that Intra needs; see the stamp spec linked from
+// [NewDNSCryptResolver].
+func parseDNSCryptStamp(stamp string) (addr *net.UDPAddr, providerName string, serverPk [32]byte, err error) {
+	const prefix = "sdns://"
+	if !strings.HasPrefix(stamp, prefix) {
+		err = errors.New("missing sdns:// prefix")
+		return
+	}
+	raw, decErr := base64.RawURLEncoding.DecodeString(stamp[len(prefix):])
+	if decErr != nil {
+		err = fmt.Errorf("invalid base64: %w", decErr)
+		return
+	}
+	// Wire layout: protocol(1) | props(8) | addr-len(1) | addr | pk-len(1) | pk(32) | name-len(1) | name
+	if len(raw) < 1 || raw[0] != 0x02 {
+		err = errors.New("not a DNSCrypt stamp")
+		return
+	}
+	p := raw[9:] // skip protocol + props
+	p, addrStr, err := readLV(p)
+	if err != nil {
+		return
+	}
+	p, pk, err := readLV(p)
+	if err != nil {
+		return
+	}
+	if len(pk) != 32 {
+		err = fmt.Errorf("unexpected public key length %d", len(pk))
+		return
+	}
+	copy(serverPk[:], pk)
+	_, name, err := readLV(p)
+	if err != nil {
+		return
+	}
+	providerName = string(name)
+
+	if !strings.Contains(string(addrStr), ":") {
+		addrStr = append(addrStr, []byte(":443")...)
+	}
+	addr, err = net.ResolveUDPAddr("udp", string(addrStr))
+	return
+}
+
+// readLV reads a length-prefixed (1 byte length) field from the front of b,
+// returning the remainder and the field's contents.
+func readLV(b []byte) (rest []byte, value []byte, err error) {
+	if len(b) < 1 {
+		return nil, nil, errors.New("truncated stamp")
+	}
+	n := int(b[0])
+	if len(b) < 1+n {
+		return nil, nil, errors.New("truncated stamp field")
+	}
+	return b[1+n:], b[1 : 1+n], nil
+}
+
+// resolveCert fetches (or reuses a cached) certificate for the provider, and
+// returns the negotiated short-term keys needed to encrypt the next query.
+// Certificates are retrieved as TXT records of `providerName`, signed by the
+// server's long-term key; [parseCertTXTResponse] rejects any record whose
+// signature doesn't validate against that key before it reaches here.
+func (r *dnscryptResolver) resolveCert(ctx context.Context) (*dnscryptCert, error) {
+	r.certMu.RLock()
+	cert := r.cert
+	r.certMu.RUnlock()
+	if cert != nil && cert.valid(time.Now()) {
+		return cert, nil
+	}
+
+	cert, err := fetchDNSCryptCert(ctx, r.dialer, r.serverAddr, r.providerName, r.serverPk)
+	if err != nil {
+		return nil, err
+	}
+
+	r.certMu.Lock()
+	r.cert = cert
+	r.certTime = time.Now()
+	r.certMu.Unlock()
+	return cert, nil
+}
+
+func (r *dnscryptResolver) Query(ctx context.Context, q []byte) ([]byte, error) {
+	var token Token
+	if r.listener != nil {
+		token = r.listener.OnQuery(r.url)
+	}
+	before := time.Now()
+	resp, status, qerr := r.doQuery(ctx, q)
+	latency := time.Since(before)
+
+	if r.listener != nil {
+		r.listener.OnResponse(token, &Summary{
+			Latency:  latency.Seconds(),
+			Query:    q,
+			Response: resp,
+			Server:   r.serverAddr.String(),
+			Status:   status,
+		})
+	}
+	return resp, qerr
+}
+
+func (r *dnscryptResolver) doQuery(ctx context.Context, q []byte) ([]byte, int, error) {
+	cert, err := r.resolveCert(ctx)
+	if err != nil {
+		return nil, SendFailed, err
+	}
+
+	clientPk, clientSk, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, InternalError, err
+	}
+
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:12]); err != nil {
+		return nil, InternalError, err
+	}
+	// The second half of the nonce is filled in by the server with its own
+	// random bytes; the client only ever sends zeroes there.
+
+	padded := padQuery(q)
+	var encrypted []byte
+	switch cert.esVersion {
+	case esVersionXChaCha20Poly1305:
+		aead, err := chacha20poly1305.NewX(deriveSharedKey(cert.serverPk, *clientSk))
+		if err != nil {
+			return nil, InternalError, err
+		}
+		encrypted = aead.Seal(nil, nonce[:], padded, nil)
+	case esVersionXSalsa20Poly1305:
+		encrypted = box.SealAfterPrecomputation(nil, padded, &nonce, sharedKeyXSalsa(cert.serverPk, *clientSk))
+	default:
+		return nil, InternalError, fmt.Errorf("unsupported es-version %d", cert.esVersion)
+	}
+
+	packet := make([]byte, 0, 8+32+24+len(encrypted))
+	packet = append(packet, clientMagic[:]...)
+	packet = append(packet, clientPk[:]...)
+	packet = append(packet, nonce[:]...)
+	packet = append(packet, encrypted...)
+
+	logging.Dbg("DNSCrypt(doQuery) - sending encrypted query", "server", r.serverAddr, "len", len(packet))
+	resp, err := sendDNSCryptPacket(ctx, r.dialer, r.serverAddr, packet)
+	if err != nil {
+		return nil, SendFailed, err
+	}
+
+	plaintext, err := decryptDNSCryptResponse(resp, cert, *clientPk, *clientSk, nonce)
+	if err != nil {
+		return nil, BadResponse, err
+	}
+	return plaintext, Complete, nil
+}
+
+func (r *dnscryptResolver) GetURL() string {
+	return r.url
+}
+
+// deriveSharedKey computes the XChaCha20-Poly1305 key shared between the
+// client and the server's short-term public key. Per the DNSCrypt spec, this
+// isn't the raw X25519 ECDH output: it's run through HChaCha20 first (the
+// same construction libsodium's crypto_box_curve25519xchacha20poly1305_beforenm
+// uses), which is what lets the raw ECDH secret double as a symmetric key in
+// the first place.
+func deriveSharedKey(serverPk [32]byte, clientSk [32]byte) []byte {
+	shared, err := curve25519.X25519(clientSk[:], serverPk[:])
+	if err != nil {
+		// Only reachable on a malformed server key, which fetchDNSCryptCert
+		// should already have rejected.
+		panic(err)
+	}
+	key, err := chacha20.HChaCha20(shared, make([]byte, 16))
+	if err != nil {
+		// Only reachable if shared weren't exactly 32 bytes, which X25519
+		// guarantees above.
+		panic(err)
+	}
+	return key
+}
+
+func sharedKeyXSalsa(serverPk, clientSk [32]byte) *[32]byte {
+	var shared [32]byte
+	box.Precompute(&shared, &serverPk, &clientSk)
+	return &shared
+}
+
+// padQuery pads q with a 0x80 byte followed by zeroes up to a multiple of 64
+// bytes, per the DNSCrypt padding scheme.
+func padQuery(q []byte) []byte {
+	const blockSize = 64
+	padded := make([]byte, len(q)+1, (len(q)/blockSize+1)*blockSize)
+	copy(padded, q)
+	padded[len(q)] = 0x80
+	for len(padded)%blockSize != 0 {
+		padded = append(padded, 0)
+	}
+	return padded
+}
+
+func unpadResponse(padded []byte) ([]byte, error) {
+	for i := len(padded) - 1; i >= 0; i-- {
+		switch padded[i] {
+		case 0x80:
+			return padded[:i], nil
+		case 0:
+			continue
+		default:
+			return nil, errBadResponse
+		}
+	}
+	return nil, errBadResponse
+}
+
+// fetchDNSCryptCert and sendDNSCryptPacket perform the network I/O for
+// DNSCrypt: retrieving the server's current certificate, and exchanging one
+// encrypted query/response datagram. They are kept separate from the crypto
+// helpers above so that the framing logic can be unit tested independently.
+func fetchDNSCryptCert(ctx context.Context, dialer *net.Dialer, addr *net.UDPAddr, providerName string, serverPk [32]byte) (*dnscryptCert, error) {
+	conn, err := dialer.DialContext(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	certQuery := buildCertTXTQuery(providerName)
+	if _, err := conn.Write(certQuery); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(tcpTimeout))
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("cert fetch: %w", err)
+	}
+	return parseCertTXTResponse(buf[:n], serverPk)
+}
+
+func sendDNSCryptPacket(ctx context.Context, dialer *net.Dialer, addr *net.UDPAddr, packet []byte) ([]byte, error) {
+	conn, err := dialer.DialContext(ctx, "udp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write(packet); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetReadDeadline(deadline)
+	} else {
+		conn.SetReadDeadline(time.Now().Add(tcpTimeout))
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// decryptDNSCryptResponse validates the server magic and nonce echo, then
+// decrypts the response with the same construction used for the query.
+func decryptDNSCryptResponse(resp []byte, cert *dnscryptCert, clientPk, clientSk [32]byte, sentNonce [24]byte) ([]byte, error) {
+	const serverMagicLen = 8
+	const nonceLen = 24
+	if len(resp) < serverMagicLen+nonceLen {
+		return nil, errBadResponse
+	}
+	if string(resp[:serverMagicLen]) != "r6fnvWj8" {
+		return nil, errBadResponse
+	}
+	var nonce [24]byte
+	copy(nonce[:], resp[serverMagicLen:serverMagicLen+nonceLen])
+	if string(nonce[:12]) != string(sentNonce[:12]) {
+		return nil, errBadResponse
+	}
+	ciphertext := resp[serverMagicLen+nonceLen:]
+
+	var padded []byte
+	var err error
+	switch cert.esVersion {
+	case esVersionXChaCha20Poly1305:
+		aead, aeadErr := chacha20poly1305.NewX(deriveSharedKey(cert.serverPk, clientSk))
+		if aeadErr != nil {
+			return nil, aeadErr
+		}
+		padded, err = aead.Open(nil, nonce[:], ciphertext, nil)
+	case esVersionXSalsa20Poly1305:
+		var ok bool
+		padded, ok = box.OpenAfterPrecomputation(nil, ciphertext, &nonce, sharedKeyXSalsa(cert.serverPk, clientSk))
+		if !ok {
+			err = errBadResponse
+		}
+	default:
+		err = fmt.Errorf("unsupported es-version %d", cert.esVersion)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return unpadResponse(padded)
+}
+
+// buildCertTXTQuery builds a real, ID-less DNS TXT query for providerName.
+// [fetchDNSCryptCert] doesn't attempt to match the response against a query
+// ID because the certificate exchange happens over its own short-lived UDP
+// socket.
+func buildCertTXTQuery(providerName string) []byte {
+	q := make([]byte, 0, 32+len(providerName))
+	q = append(q, 0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0)
+	for _, label := range strings.Split(strings.TrimSuffix(providerName, "."), ".") {
+		q = append(q, byte(len(label)))
+		q = append(q, label...)
+	}
+	q = append(q, 0, 0, 16, 0, 1) // QTYPE=TXT, QCLASS=IN
+	return q
+}
+
+// dnscryptCertMagic and dnscryptCertFixedLen describe the fixed-size prefix
+// of a DNSCrypt certificate (https://dnscrypt.info/protocol, "Certificates"):
+// magic(4) | es-version(2) | protocol-minor-version(2) | signature(64) |
+// resolver-pk(32) | client-magic(8) | serial(4) | ts-start(4) | ts-end(4),
+// optionally followed by extensions this client ignores.
+const (
+	dnscryptCertMagic    = "DNSC"
+	dnscryptCertFixedLen = 4 + 2 + 2 + 64 + 32 + 8 + 4 + 4 + 4
+)
+
+// parseCertTXTResponse unpacks resp as a real DNS message, and returns the
+// most recently expiring certificate among its TXT answers whose signature
+// validates against expectedProviderPk - the provider's long-term key, taken
+// from the stamp. A provider may publish more than one valid certificate
+// (e.g. during key rollover); a TXT record that isn't a well-formed, validly
+// signed certificate is skipped rather than treated as fatal, since a real
+// resolver.dial-style caller only needs one good certificate to proceed.
+func parseCertTXTResponse(resp []byte, expectedProviderPk [32]byte) (*dnscryptCert, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadCert, err)
+	}
+
+	var best *dnscryptCert
+	for _, a := range msg.Answers {
+		txt, ok := a.Body.(*dnsmessage.TXTResource)
+		if !ok {
+			continue
+		}
+		cert, err := parseSignedCert(concatTXTStrings(txt.TXT), expectedProviderPk)
+		if err != nil {
+			continue
+		}
+		if best == nil || cert.notAfter > best.notAfter {
+			best = cert
+		}
+	}
+	if best == nil {
+		return nil, errBadCert
+	}
+	return best, nil
+}
+
+// concatTXTStrings joins a TXT record's character-strings back into the
+// single blob they encode; DNSCrypt certificates routinely exceed the
+// 255-byte limit of one character-string and are split across several.
+func concatTXTStrings(strs []string) []byte {
+	var b []byte
+	for _, s := range strs {
+		b = append(b, s...)
+	}
+	return b
+}
+
+// parseSignedCert parses one DNSCrypt certificate and verifies its Ed25519
+// signature against expectedProviderPk, returning errBadCert if the magic,
+// length, or signature don't check out. Without this, any attacker able to
+// put a UDP packet in front of fetchDNSCryptCert's socket could forge a
+// certificate and MITM every subsequent query.
+func parseSignedCert(cert []byte, expectedProviderPk [32]byte) (*dnscryptCert, error) {
+	if len(cert) < dnscryptCertFixedLen || string(cert[:4]) != dnscryptCertMagic {
+		return nil, errBadCert
+	}
+	esVersion := dnscryptEsVersion(uint16(cert[4])<<8 | uint16(cert[5]))
+	signature := cert[8 : 8+64]
+	signed := cert[8+64:] // resolver-pk || client-magic || serial || ts-start || ts-end [|| extensions]
+	if !ed25519.Verify(expectedProviderPk[:], signed, signature) {
+		return nil, errBadCert
+	}
+
+	var serverPk [32]byte
+	copy(serverPk[:], signed[:32])
+	validity := signed[32+8+4:] // skip resolver-pk, client-magic, serial
+	notBefore := binary.BigEndian.Uint32(validity[0:4])
+	notAfter := binary.BigEndian.Uint32(validity[4:8])
+	return &dnscryptCert{
+		esVersion: esVersion,
+		serverPk:  serverPk,
+		notBefore: notBefore,
+		notAfter:  notAfter,
+	}, nil
+}
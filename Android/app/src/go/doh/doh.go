@@ -36,6 +36,7 @@ import (
 	"localhost/Intra/Android/app/src/go/intra/split"
 	"localhost/Intra/Android/app/src/go/logging"
 
+	"github.com/quic-go/quic-go/http3"
 	"golang.org/x/net/dns/dnsmessage"
 )
 
@@ -66,7 +67,9 @@ type Summary struct {
 	Response   []byte
 	Server     string
 	Status     int
-	HTTPStatus int // Zero unless Status is Complete or HTTPError
+	HTTPStatus int    // Zero unless Status is Complete or HTTPError
+	Protocol   string // "h2" or "h3": which transport served this query
+	RaceWinner string // Set by MultiResolver: the upstream URL that answered this query.
 }
 
 // A Token is an opaque handle used to match responses to queries.
@@ -103,11 +106,75 @@ type resolver struct {
 	listener           Listener
 	hangoverLock       sync.RWMutex
 	hangoverExpiration time.Time
+
+	// preferH3, h3Client, and h3Transport are non-nil/true together: set by
+	// NewResolver when PreferH3 is requested for an https:// template. See
+	// doh3.go.
+	preferH3    bool
+	h3Client    *http.Client
+	h3Transport *http3.Transport
+
+	// protocolLock guards winningProtocol, the winning protocol of the last
+	// race (see sendRequestRacing in doh3.go), so a server that's already
+	// shown it answers H3 doesn't need to be re-raced on every query.
+	protocolLock    sync.RWMutex
+	winningProtocol string
+
+	// happyEyeballs paces resolver.dial's Happy Eyeballs v2 race over this
+	// server's candidate IPs; see HappyEyeballsConfig.
+	happyEyeballs HappyEyeballsConfig
+}
+
+// HappyEyeballsConfig controls the pacing of the RFC 8305 Happy Eyeballs v2
+// race resolver.dial runs over a DoH server's candidate IPs (see dial).
+type HappyEyeballsConfig struct {
+	// ConnectionAttemptDelay staggers successive connection attempts, per
+	// RFC 8305's "Connection Attempt Delay". Zero means
+	// DefaultHappyEyeballsConfig's value.
+	ConnectionAttemptDelay time.Duration
+
+	// ResolutionDelay is RFC 8305's "Resolution Delay": the grace period
+	// ipmap gives a slow-to-arrive AAAA lookup before proceeding with
+	// whatever A addresses already arrived, instead of always waiting for
+	// both families (see ipmap.IPSet.bootstrap). Zero means don't wait for
+	// AAAA at all once A has returned.
+	ResolutionDelay time.Duration
+}
+
+// DefaultHappyEyeballsConfig is the HappyEyeballsConfig NewResolver uses
+// when none is given.
+var DefaultHappyEyeballsConfig = HappyEyeballsConfig{
+	ConnectionAttemptDelay: 250 * time.Millisecond,
+	ResolutionDelay:        50 * time.Millisecond,
+}
+
+// addrIP extracts the peer IP from a net.Addr produced by either transport
+// this resolver can use: a *net.TCPAddr from the HTTP/2 path, or a
+// *net.UDPAddr from the HTTP/3 path (see doh3.go). It returns nil for
+// anything else, including a nil addr.
+func addrIP(a net.Addr) net.IP {
+	switch v := a.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	default:
+		return nil
+	}
 }
 
 // Wait up to three seconds for the TCP handshake to complete.
 const tcpTimeout time.Duration = 3 * time.Second
 
+// dial races every candidate IP for domain per RFC 8305 Happy Eyeballs v2:
+// the confirmed IP (if any) is promoted to the head of the list, the rest
+// are ordered by RFC 6724 destination address selection
+// (ipmap.IPSet.GetAllSorted) and then interleaved by family and staggered
+// by r.happyEyeballs's ConnectionAttemptDelay (split.raceDial does the
+// interleaving), and the first successful connection wins. The winning IP
+// is confirmed; the confirmed IP is only disconfirmed if every candidate -
+// including it - failed, since losing the race to a faster candidate isn't
+// evidence the confirmed IP stopped working.
 func (r *resolver) dial(ctx context.Context, network, addr string) (net.Conn, error) {
 	logging.Debug("DoH(resolver.dial) - dialing", "addr", addr)
 	domain, portStr, err := net.SplitHostPort(addr)
@@ -123,32 +190,38 @@ func (r *resolver) dial(ctx context.Context, network, addr string) (net.Conn, er
 		return &net.TCPAddr{IP: ip, Port: port}
 	}
 
-	// TODO: Improve IP fallback strategy with parallelism and Happy Eyeballs.
-	var conn net.Conn
 	ips := r.ips.Get(domain)
 	confirmed := ips.Confirmed()
+	sorted := ips.GetAllSorted(r.dialer)
+	addrs := make([]*net.TCPAddr, 0, len(sorted))
 	if confirmed != nil {
-		logging.Debug("DoH(resolver.dial) - trying confirmed IP", "confirmedIP", confirmed, "addr", addr)
-		if conn, err = split.DialWithSplitRetry(ctx, r.dialer, tcpaddr(confirmed), nil); err == nil {
-			logging.Info("DoH(resolver.dial) - confirmed IP worked", "confirmedIP", confirmed)
-			return conn, nil
-		}
-		logging.Debug("DoH(resolver.dial) - confirmed IP failed", "confirmedIP", confirmed, "err", err)
-		ips.Disconfirm(confirmed)
+		addrs = append(addrs, tcpaddr(confirmed))
 	}
-
-	logging.Debug("DoH(resolver.dial) - trying all IPs")
-	for _, ip := range ips.GetAll() {
+	for _, ip := range sorted {
 		if ip.Equal(confirmed) {
-			// Don't try this IP twice.
 			continue
 		}
-		if conn, err = split.DialWithSplitRetry(ctx, r.dialer, tcpaddr(ip), nil); err == nil {
-			logging.Info("DoH(resolver.dial) - found working IP", "ip", ip)
-			return conn, nil
+		addrs = append(addrs, tcpaddr(ip))
+	}
+
+	stats := &split.RetryStats{}
+	logging.Debug("DoH(resolver.dial) - racing addrs", "addrs", addrs)
+	conn, err := split.DialWithSplitRetryAddrsDelayPolicy(
+		ctx, r.dialer, addrs, stats, r.happyEyeballs.ConnectionAttemptDelay, split.DefaultPolicy)
+	if err != nil {
+		logging.Debug("DoH(resolver.dial) - every IP failed", "addrs", addrs, "err", err)
+		if confirmed != nil {
+			ips.Disconfirm(confirmed)
+		}
+		return nil, err
+	}
+	logging.Info("DoH(resolver.dial) - found working IP", "winner", stats.WinnerAddr)
+	if winnerHost, _, splitErr := net.SplitHostPort(stats.WinnerAddr); splitErr == nil {
+		if winnerIP := net.ParseIP(winnerHost); winnerIP != nil {
+			ips.Confirm(winnerIP)
 		}
 	}
-	return nil, err
+	return conn, nil
 }
 
 // NewResolver returns a DoH [Resolver], ready for use.
@@ -164,8 +237,16 @@ func (r *resolver) dial(ctx context.Context, network, addr string) (net.Conn, er
 //
 // `auth` will provide a client certificate if required by the TLS server.
 //
+// `preferH3` builds an additional HTTP/3 (QUIC) transport alongside the
+// usual HTTP/2 one, and has sendRequest race the two per query, latching
+// onto whichever protocol wins until it stops working; see doh3.go.
+//
+// `happyEyeballs` configures the pacing of dial's RFC 8305 Happy Eyeballs
+// v2 race over this server's candidate IPs; nil uses
+// DefaultHappyEyeballsConfig.
+//
 // `listener` will receive the status of each DNS query when it is complete.
-func NewResolver(rawurl string, addrs []string, dialer *net.Dialer, auth ClientAuth, listener Listener) (Resolver, error) {
+func NewResolver(rawurl string, addrs []string, dialer *net.Dialer, auth ClientAuth, preferH3 bool, happyEyeballs *HappyEyeballsConfig, listener Listener) (Resolver, error) {
 	if dialer == nil {
 		dialer = &net.Dialer{}
 	}
@@ -188,13 +269,21 @@ func NewResolver(rawurl string, addrs []string, dialer *net.Dialer, auth ClientA
 		port = 443
 	}
 
+	effectiveHappyEyeballs := DefaultHappyEyeballsConfig
+	if happyEyeballs != nil {
+		effectiveHappyEyeballs = *happyEyeballs
+	}
+	if effectiveHappyEyeballs.ConnectionAttemptDelay == 0 {
+		effectiveHappyEyeballs.ConnectionAttemptDelay = DefaultHappyEyeballsConfig.ConnectionAttemptDelay
+	}
 	t := &resolver{
-		url:      rawurl,
-		hostname: parsedurl.Hostname(),
-		port:     port,
-		listener: listener,
-		dialer:   dialer,
-		ips:      ipmap.NewIPMap(dialer.Resolver),
+		url:           rawurl,
+		hostname:      parsedurl.Hostname(),
+		port:          port,
+		listener:      listener,
+		dialer:        dialer,
+		ips:           ipmap.NewIPMap(dialer.Resolver, effectiveHappyEyeballs.ResolutionDelay),
+		happyEyeballs: effectiveHappyEyeballs,
 	}
 	ips := t.ips.Get(t.hostname)
 	for _, addr := range addrs {
@@ -205,12 +294,15 @@ func NewResolver(rawurl string, addrs []string, dialer *net.Dialer, auth ClientA
 	}
 
 	// Supply a client certificate during TLS handshakes.
-	var tlsconfig *tls.Config
+	tlsconfig := &tls.Config{
+		// Negotiate h2 explicitly rather than relying on ForceAttemptHTTP2's
+		// implicit default, so it's visible here alongside h3's ALPN in
+		// doh3.go.
+		NextProtos: []string{"h2", "http/1.1"},
+	}
 	if auth != nil {
 		signer := newClientAuthWrapper(auth)
-		tlsconfig = &tls.Config{
-			GetClientCertificate: signer.GetClientCertificate,
-		}
+		tlsconfig.GetClientCertificate = signer.GetClientCertificate
 	}
 
 	// Override the dial function.
@@ -221,6 +313,12 @@ func NewResolver(rawurl string, addrs []string, dialer *net.Dialer, auth ClientA
 		ResponseHeaderTimeout: 20 * time.Second, // Same value as Android DNS-over-TLS
 		TLSClientConfig:       tlsconfig,
 	}
+
+	if preferH3 {
+		t.preferH3 = true
+		t.h3Transport = t.newH3Transport()
+		t.h3Client = &http.Client{Transport: t.h3Transport}
+	}
 	return t, nil
 }
 
@@ -251,7 +349,7 @@ func (e *httpError) Error() string {
 // Independent of the query's success or failure, this function also returns the
 // address of the server on a best-effort basis, or nil if the address could not
 // be determined.
-func (r *resolver) doQuery(ctx context.Context, q []byte) (response []byte, server *net.TCPAddr, qerr *queryError) {
+func (r *resolver) doQuery(ctx context.Context, q []byte) (response []byte, server net.Addr, protocol string, qerr *queryError) {
 	if len(q) < 2 {
 		qerr = &queryError{BadQuery, fmt.Errorf("Query length is %d", len(q))}
 		return
@@ -276,14 +374,9 @@ func (r *resolver) doQuery(ctx context.Context, q []byte) (response []byte, serv
 	// Zero out the query ID.
 	id := binary.BigEndian.Uint16(q)
 	binary.BigEndian.PutUint16(q, 0)
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewBuffer(q))
-	if err != nil {
-		qerr = &queryError{InternalError, err}
-		return
-	}
 
 	var hostname string
-	response, hostname, server, qerr = r.sendRequest(id, req)
+	response, hostname, server, protocol, qerr = r.sendRequest(ctx, id, q)
 
 	// Restore the query ID.
 	binary.BigEndian.PutUint16(q, id)
@@ -307,14 +400,41 @@ func (r *resolver) doQuery(ctx context.Context, q []byte) (response []byte, serv
 		}
 
 		response = tryServfail(q)
-	} else if server != nil {
+	} else if ip := addrIP(server); ip != nil {
 		// Record a working IP address for this server iff qerr is nil
-		r.ips.Get(hostname).Confirm(server.IP)
+		r.ips.Get(hostname).Confirm(ip)
 	}
 	return
 }
 
-func (r *resolver) sendRequest(id uint16, req *http.Request) (response []byte, hostname string, server *net.TCPAddr, qerr *queryError) {
+// sendRequest dispatches the (already-padded, zeroed-ID) query q over
+// whichever transport(s) this resolver was built with: just H2, or - when
+// PreferH3 was set - a race between H2 and H3 (or, once a server has shown
+// it answers one of them, just that one; see doh3.go). Each attempt gets
+// its own *http.Request built from q, since http.Request.Clone doesn't
+// duplicate the body, and a race needs two independent readers of it.
+func (r *resolver) sendRequest(ctx context.Context, id uint16, q []byte) (response []byte, hostname string, server net.Addr, protocol string, qerr *queryError) {
+	if !r.preferH3 {
+		req, err := r.newRequest(ctx, q)
+		if err != nil {
+			qerr = &queryError{InternalError, err}
+			return
+		}
+		response, hostname, server, qerr = r.sendRequestH2(id, req)
+		protocol = protocolH2
+		return
+	}
+	return r.sendRequestRacing(ctx, id, q)
+}
+
+// newRequest builds the POST request for one query attempt. Each attempt
+// (H2, H3, or a retry of either) needs its own *http.Request wrapping its
+// own reader over q, since http.Request.Clone shares the original Body.
+func (r *resolver) newRequest(ctx context.Context, q []byte) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(q))
+}
+
+func (r *resolver) sendRequestH2(id uint16, req *http.Request) (response []byte, hostname string, server net.Addr, qerr *queryError) {
 	hostname = r.hostname
 
 	// The connection used for this request.  If the request fails, we will close
@@ -324,17 +444,26 @@ func (r *resolver) sendRequest(id uint16, req *http.Request) (response []byte, h
 	// Error cleanup function.  If the query fails, this function will close the
 	// underlying socket and disconfirm the server IP.  Empirically, sockets often
 	// become unresponsive after a network change, causing timeouts on all requests.
+	//
+	// A canceled query (e.g. Accept's context canceled at shutdown, see
+	// resolver.Query) is treated differently: the socket is still closed
+	// eagerly here, via the net.Conn GotConn already captured below, so it's
+	// released immediately instead of idling until the transport's own
+	// timeout - but the IP isn't disconfirmed, since cancellation isn't
+	// evidence that it stopped working.
 	defer func() {
 		if qerr == nil {
 			return
 		}
-		logging.Info("DoH(resolver.sendRequest) - done", "id", id, "queryError", qerr)
-		if server != nil {
-			logging.Debug("DoH(resolver.sendRequest) - disconfirming IP", "id", id, "ip", server.IP)
-			r.ips.Get(hostname).Disconfirm(server.IP)
+		logging.Info("DoH(resolver.sendRequestH2) - done", "id", id, "queryError", qerr)
+		if errors.Is(qerr, context.Canceled) {
+			logging.Debug("DoH(resolver.sendRequestH2) - query canceled", "id", id)
+		} else if ip := addrIP(server); ip != nil {
+			logging.Debug("DoH(resolver.sendRequestH2) - disconfirming IP", "id", id, "ip", ip)
+			r.ips.Get(hostname).Disconfirm(ip)
 		}
 		if conn != nil {
-			logging.Info("DoH(resolver.sendRequest) - closing failing DoH socket", "id", id)
+			logging.Info("DoH(resolver.sendRequestH2) - closing failing DoH socket", "id", id)
 			conn.Close()
 		}
 	}()
@@ -353,8 +482,7 @@ func (r *resolver) sendRequest(id uint16, req *http.Request) (response []byte, h
 				return
 			}
 			conn = info.Conn
-			// info.Conn is a DuplexConn, so RemoteAddr is actually a TCPAddr.
-			server = conn.RemoteAddr().(*net.TCPAddr)
+			server = conn.RemoteAddr()
 		},
 		PutIdleConn: func(err error) {
 			logging.Debugf("%d PutIdleConn(%v)", id, err)
@@ -400,20 +528,20 @@ func (r *resolver) sendRequest(id uint16, req *http.Request) (response []byte, h
 	req.Header.Set("Content-Type", mimetype)
 	req.Header.Set("Accept", mimetype)
 	req.Header.Set("User-Agent", "Intra")
-	logging.Debug("DoH(resolver.sendRequest) - sending query", "id", id)
+	logging.Debug("DoH(resolver.sendRequestH2) - sending query", "id", id)
 	httpResponse, err := r.client.Do(req)
 	if err != nil {
 		qerr = &queryError{SendFailed, err}
 		return
 	}
-	logging.Debug("DoH(resolver.sendRequest) - got response", "id", id)
+	logging.Debug("DoH(resolver.sendRequestH2) - got response", "id", id)
 	response, err = io.ReadAll(httpResponse.Body)
 	if err != nil {
 		qerr = &queryError{BadResponse, err}
 		return
 	}
 	httpResponse.Body.Close()
-	logging.Debug("DoH(resolver.sendRequest) - response closed", "id", id)
+	logging.Debug("DoH(resolver.sendRequestH2) - response closed", "id", id)
 
 	// Update the hostname, which could have changed due to a redirect.
 	hostname = httpResponse.Request.URL.Hostname()
@@ -423,7 +551,7 @@ func (r *resolver) sendRequest(id uint16, req *http.Request) (response []byte, h
 		req.Write(reqBuf)
 		respBuf := new(bytes.Buffer)
 		httpResponse.Write(respBuf)
-		logging.Debug("DoH(resolver.sendRequest) - response invalid", "id", id, "req", reqBuf, "resp", respBuf)
+		logging.Debug("DoH(resolver.sendRequestH2) - response invalid", "id", id, "req", reqBuf, "resp", respBuf)
 
 		qerr = &queryError{HTTPError, &httpError{httpResponse.StatusCode}}
 		return
@@ -432,6 +560,11 @@ func (r *resolver) sendRequest(id uint16, req *http.Request) (response []byte, h
 	return
 }
 
+// Query implements Resolver.Query. If ctx is canceled (as Accept's context
+// is, once its read loop exits) while a request is in flight, the
+// underlying HTTP connection is closed eagerly by sendRequestH2's own
+// cleanup path rather than left to the transport's idle timeout, so
+// cancellation actually frees the socket instead of just abandoning it.
 func (r *resolver) Query(ctx context.Context, q []byte) ([]byte, error) {
 	var token Token
 	if r.listener != nil {
@@ -439,7 +572,7 @@ func (r *resolver) Query(ctx context.Context, q []byte) ([]byte, error) {
 	}
 
 	before := time.Now()
-	response, server, qerr := r.doQuery(ctx, q)
+	response, server, protocol, qerr := r.doQuery(ctx, q)
 	after := time.Now()
 
 	errIsCancel := false
@@ -472,8 +605,8 @@ func (r *resolver) Query(ctx context.Context, q []byte) ([]byte, error) {
 	if r.listener != nil && !errIsCancel {
 		latency := after.Sub(before)
 		var ip string
-		if server != nil {
-			ip = server.IP.String()
+		if addr := addrIP(server); addr != nil {
+			ip = addr.String()
 		}
 
 		r.listener.OnResponse(token, &Summary{
@@ -483,6 +616,7 @@ func (r *resolver) Query(ctx context.Context, q []byte) ([]byte, error) {
 			Server:     ip,
 			Status:     status,
 			HTTPStatus: httpStatus,
+			Protocol:   protocol,
 		})
 	}
 	return response, err
@@ -493,8 +627,8 @@ func (r *resolver) GetURL() string {
 }
 
 // Perform a query using the Resolver, and send the response to the writer.
-func forwardQuery(r Resolver, q []byte, c io.Writer) error {
-	resp, qerr := r.Query(context.Background(), q)
+func forwardQuery(ctx context.Context, r Resolver, q []byte, c io.Writer) error {
+	resp, qerr := r.Query(ctx, q)
 	if resp == nil && qerr != nil {
 		return qerr
 	}
@@ -519,15 +653,25 @@ func forwardQuery(r Resolver, q []byte, c io.Writer) error {
 
 // Perform a query using the Resolver, send the response to the writer,
 // and close the writer if there was an error.
-func forwardQueryAndCheck(r Resolver, q []byte, c io.WriteCloser) {
-	if err := forwardQuery(r, q, c); err != nil {
+func forwardQueryAndCheck(ctx context.Context, r Resolver, q []byte, c io.WriteCloser) {
+	if err := forwardQuery(ctx, r, q, c); err != nil {
 		logging.Warn("DoH(forwardQueryAndCheck) - forwarding failed", "err", err)
 		c.Close()
 	}
 }
 
 // Accept a DNS-over-TCP socket, and connect the socket to a DoH Resolver.
+// Every query this socket forwards shares one context, which Accept
+// cancels as soon as its read loop exits, so an in-flight query doesn't
+// keep its HTTP connection - or its own goroutine - alive past the
+// socket's own lifetime (see resolver.Query's handling of
+// context.Canceled). Accept waits for every such goroutine to finish
+// before it returns, so a caller that waits on Accept can rely on every
+// query it spawned having fully drained.
 func Accept(r Resolver, c io.ReadWriteCloser) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
 	qlbuf := make([]byte, 2)
 	for {
 		n, err := c.Read(qlbuf)
@@ -554,9 +698,14 @@ func Accept(r Resolver, c io.ReadWriteCloser) {
 			logging.Warn("DoH(Accept) - incomplete query (n < qlen)", "n", n, "qlen", qlen)
 			break
 		}
-		go forwardQueryAndCheck(r, q, c)
-	}
-	// TODO: Cancel outstanding queries at this point.
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			forwardQueryAndCheck(ctx, r, q, c)
+		}()
+	}
+	cancel()
+	wg.Wait()
 	c.Close()
 }
 
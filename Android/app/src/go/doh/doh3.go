@@ -0,0 +1,234 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"localhost/Intra/Android/app/src/go/logging"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	protocolH2 = "h2"
+	protocolH3 = "h3"
+)
+
+// newH3Transport builds the HTTP/3 (QUIC) RoundTripper for a resolver with
+// PreferH3 set. Its Dial hook reuses this resolver's own IP pool - the same
+// ipmap.IPSet the HTTP/2 path confirms and disconfirms against - instead of
+// quic-go's default hostname resolution.
+func (r *resolver) newH3Transport() *http3.Transport {
+	return &http3.Transport{
+		TLSClientConfig: &tls.Config{NextProtos: []string{"h3"}},
+		Dial:            r.dialQUIC,
+	}
+}
+
+// dialQUIC is resolver.dial's HTTP/3 counterpart over the same IP pool, but
+// over a UDP socket with a QUIC handshake instead of TCP+TLS, and one
+// candidate at a time instead of dial's race: the confirmed IP first, then
+// every other known IP in turn. The IP whose handshake succeeds is
+// confirmed. A failed handshake against the confirmed IP disconfirms it
+// right away (dial only disconfirms once every candidate has failed) -
+// sendRequestRacing's fallback to H2 is what actually recovers the query.
+func (r *resolver) dialQUIC(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	logging.Debug("DoH(resolver.dialQUIC) - dialing", "addr", addr)
+	domain, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, err
+	}
+	udpaddr := func(ip net.IP) *net.UDPAddr {
+		return &net.UDPAddr{IP: ip, Port: port}
+	}
+
+	pconn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	dialed := false
+	defer func() {
+		if !dialed {
+			pconn.Close()
+		}
+	}()
+
+	ips := r.ips.Get(domain)
+	confirmed := ips.Confirmed()
+	if confirmed != nil {
+		if conn, err := quic.DialEarly(ctx, pconn, udpaddr(confirmed), tlsCfg, cfg); err == nil {
+			logging.Info("DoH(resolver.dialQUIC) - confirmed IP worked", "confirmedIP", confirmed)
+			dialed = true
+			return conn, nil
+		}
+		logging.Debug("DoH(resolver.dialQUIC) - confirmed IP failed", "confirmedIP", confirmed)
+		ips.Disconfirm(confirmed)
+	}
+
+	var lastErr error = errors.New("no IP addresses available")
+	for _, ip := range ips.GetAll() {
+		if ip.Equal(confirmed) {
+			continue
+		}
+		conn, err := quic.DialEarly(ctx, pconn, udpaddr(ip), tlsCfg, cfg)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		logging.Info("DoH(resolver.dialQUIC) - found working IP", "ip", ip)
+		ips.Confirm(ip)
+		dialed = true
+		return conn, nil
+	}
+	return nil, lastErr
+}
+
+// sendRequestH3 is sendRequestH2's HTTP/3 counterpart. Unlike sendRequestH2,
+// it doesn't trace the connection to learn the peer address: http3.Transport
+// doesn't expose one the way httptrace.GotConn does. dialQUIC already
+// confirms/disconfirms as it dials, so the best-effort server address
+// reported here is whichever IP is now confirmed for this hostname.
+func (r *resolver) sendRequestH3(id uint16, req *http.Request) (response []byte, server net.Addr, qerr *queryError) {
+	const mimetype = "application/dns-message"
+	req.Header.Set("Content-Type", mimetype)
+	req.Header.Set("Accept", mimetype)
+	req.Header.Set("User-Agent", "Intra")
+
+	logging.Debug("DoH(resolver.sendRequestH3) - sending query", "id", id)
+	httpResponse, err := r.h3Client.Do(req)
+	if err != nil {
+		qerr = &queryError{SendFailed, err}
+		return
+	}
+	logging.Debug("DoH(resolver.sendRequestH3) - got response", "id", id)
+	defer httpResponse.Body.Close()
+	response, err = io.ReadAll(httpResponse.Body)
+	if err != nil {
+		qerr = &queryError{BadResponse, err}
+		return
+	}
+
+	if httpResponse.StatusCode != http.StatusOK {
+		qerr = &queryError{HTTPError, &httpError{httpResponse.StatusCode}}
+		return
+	}
+
+	if confirmed := r.ips.Get(r.hostname).Confirmed(); confirmed != nil {
+		server = &net.UDPAddr{IP: confirmed, Port: r.port}
+	}
+	return
+}
+
+// latchedProtocol returns the protocol (protocolH2 or protocolH3) that won
+// this resolver's last race, or "" if none has won yet.
+func (r *resolver) latchedProtocol() string {
+	r.protocolLock.RLock()
+	defer r.protocolLock.RUnlock()
+	return r.winningProtocol
+}
+
+func (r *resolver) setLatchedProtocol(protocol string) {
+	r.protocolLock.Lock()
+	defer r.protocolLock.Unlock()
+	r.winningProtocol = protocol
+}
+
+// raceResult is one transport's outcome from sendRequestRacing.
+type raceResult struct {
+	response []byte
+	hostname string
+	server   net.Addr
+	protocol string
+	qerr     *queryError
+}
+
+// sendRequestRacing is sendRequest's PreferH3 path. If the server has
+// already latched a winning protocol, it's tried alone first, since racing
+// a server that's reliably answering one of them is wasted work; otherwise,
+// or if the latched protocol just failed, both transports are raced for the
+// first successful response, and the winner is (re-)latched. Each attempt
+// gets its own *http.Request built from q; see sendRequest.
+func (r *resolver) sendRequestRacing(ctx context.Context, id uint16, q []byte) (response []byte, hostname string, server net.Addr, protocol string, qerr *queryError) {
+	switch r.latchedProtocol() {
+	case protocolH3:
+		req, err := r.newRequest(ctx, q)
+		if err == nil {
+			resp, srv, serr := r.sendRequestH3(id, req)
+			if serr == nil {
+				return resp, r.hostname, srv, protocolH3, nil
+			}
+			logging.Debug("DoH(resolver.sendRequestRacing) - latched H3 failed, racing again", "id", id, "err", serr)
+		}
+	case protocolH2:
+		req, err := r.newRequest(ctx, q)
+		if err == nil {
+			resp, host, srv, serr := r.sendRequestH2(id, req)
+			if serr == nil {
+				return resp, host, srv, protocolH2, nil
+			}
+			logging.Debug("DoH(resolver.sendRequestRacing) - latched H2 failed, racing again", "id", id, "err", serr)
+		}
+	}
+
+	h2req, err := r.newRequest(ctx, q)
+	if err != nil {
+		qerr = &queryError{InternalError, err}
+		return
+	}
+	h3req, err := r.newRequest(ctx, q)
+	if err != nil {
+		qerr = &queryError{InternalError, err}
+		return
+	}
+
+	results := make(chan raceResult, 2)
+	go func() {
+		resp, host, srv, err := r.sendRequestH2(id, h2req)
+		results <- raceResult{resp, host, srv, protocolH2, err}
+	}()
+	go func() {
+		resp, srv, err := r.sendRequestH3(id, h3req)
+		results <- raceResult{resp, r.hostname, srv, protocolH3, err}
+	}()
+
+	var h2Failure *raceResult
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.qerr == nil {
+			r.setLatchedProtocol(res.protocol)
+			return res.response, res.hostname, res.server, res.protocol, nil
+		}
+		if res.protocol == protocolH2 {
+			res := res
+			h2Failure = &res
+		}
+	}
+	// Both failed: report the H2 attempt's error, since that's the error
+	// this resolver's callers (the hangover logic in doQuery, in particular)
+	// have always expected.
+	return nil, r.hostname, nil, protocolH2, h2Failure.qerr
+}
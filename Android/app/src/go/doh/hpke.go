@@ -0,0 +1,232 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+// This file implements the subset of HPKE (RFC 9180) that Oblivious DoH
+// (RFC 9230) needs: base-mode (no PSK, no sender authentication)
+// encapsulation with DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, and
+// AES-128-GCM - the exact ciphersuite a real ODoH target publishes in its
+// ObliviousDoHConfigContents, so a query sealed here can actually be opened
+// by a real target, unlike a from-scratch KDF/AEAD pairing that only a
+// matching from-scratch server could ever decrypt.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	hpkeKEMID  uint16 = 0x0020 // DHKEM(X25519, HKDF-SHA256)
+	hpkeKDFID  uint16 = 0x0001 // HKDF-SHA256
+	hpkeAEADID uint16 = 0x0001 // AES-128-GCM
+
+	hpkeNh = sha256.Size // Nh: HKDF-SHA256 extract output size
+	hpkeNk = 16          // Nk: AES-128-GCM key size
+	hpkeNn = 12          // Nn: AES-GCM nonce size
+)
+
+func i2osp2(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+var hpkeKEMSuiteID = append([]byte("KEM"), i2osp2(hpkeKEMID)...)
+
+var hpkeSuiteID = func() []byte {
+	b := append([]byte("HPKE"), i2osp2(hpkeKEMID)...)
+	b = append(b, i2osp2(hpkeKDFID)...)
+	return append(b, i2osp2(hpkeAEADID)...)
+}()
+
+// labeledExtract is RFC 9180 §4's LabeledExtract.
+func labeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+// labeledExpand is RFC 9180 §4's LabeledExpand.
+func labeledExpand(suiteID, prk []byte, label string, info []byte, length int) ([]byte, error) {
+	labeledInfo := i2osp2(uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo), out); err != nil {
+		return nil, fmt.Errorf("hpke: expand: %w", err)
+	}
+	return out, nil
+}
+
+func generateX25519KeyPair() (pk, sk [32]byte, err error) {
+	if _, err = rand.Read(sk[:]); err != nil {
+		return
+	}
+	pub, err := curve25519.X25519(sk[:], curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	copy(pk[:], pub)
+	return
+}
+
+// hpkeEncap implements DHKEM(X25519, HKDF-SHA256)'s Encap(pkR): generate an
+// ephemeral key pair, do the X25519 DH with pkR, and derive the KEM shared
+// secret via RFC 9180 §4.1's ExtractAndExpand. enc is the serialized
+// ephemeral public key the recipient needs to redo the DH on its side.
+func hpkeEncap(pkR [32]byte) (sharedSecret, enc []byte, err error) {
+	pkE, skE, err := generateX25519KeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	dh, err := curve25519.X25519(skE[:], pkR[:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("hpke: invalid recipient public key: %w", err)
+	}
+	kemContext := append(append([]byte{}, pkE[:]...), pkR[:]...)
+	eaePRK := labeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+	sharedSecret, err = labeledExpand(hpkeKEMSuiteID, eaePRK, "shared_secret", kemContext, hpkeNh)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sharedSecret, pkE[:], nil
+}
+
+// hpkeContext is an established HPKE encryption context (RFC 9180 §5.2):
+// the derived AEAD plus the running nonce sequence the base_nonce is XORed
+// with. It is single-directional and single-use here - one Seal of the
+// query on the sender side, or one Open of it on the recipient side - since
+// ODoH never sends more than one message per direction per context. The
+// response is not opened with this context: odohSeal.open derives its key
+// from Export instead.
+type hpkeContext struct {
+	aead           cipher.AEAD
+	baseNonce      []byte
+	seq            uint64
+	exporterSecret []byte
+}
+
+// hpkeKeySchedule implements RFC 9180 §5.1's KeySchedule for mode_base
+// (no PSK, no sender authentication).
+func hpkeKeySchedule(sharedSecret, info []byte) (*hpkeContext, error) {
+	const modeBase = 0x00
+	pskIDHash := labeledExtract(hpkeSuiteID, nil, "psk_id_hash", nil)
+	infoHash := labeledExtract(hpkeSuiteID, nil, "info_hash", info)
+	ksContext := append([]byte{modeBase}, pskIDHash...)
+	ksContext = append(ksContext, infoHash...)
+
+	secret := labeledExtract(hpkeSuiteID, sharedSecret, "secret", nil)
+	key, err := labeledExpand(hpkeSuiteID, secret, "key", ksContext, hpkeNk)
+	if err != nil {
+		return nil, err
+	}
+	baseNonce, err := labeledExpand(hpkeSuiteID, secret, "base_nonce", ksContext, hpkeNn)
+	if err != nil {
+		return nil, err
+	}
+	exporterSecret, err := labeledExpand(hpkeSuiteID, secret, "exp", ksContext, hpkeNh)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &hpkeContext{aead: aead, baseNonce: baseNonce, exporterSecret: exporterSecret}, nil
+}
+
+// hpkeSetupBaseS implements RFC 9180 §5.1.1's SetupBaseS: encapsulate a
+// shared secret for pkR and key-schedule a sender context from it.
+func hpkeSetupBaseS(pkR [32]byte, info []byte) (ctx *hpkeContext, enc []byte, err error) {
+	sharedSecret, enc, err := hpkeEncap(pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, err = hpkeKeySchedule(sharedSecret, info)
+	return ctx, enc, err
+}
+
+// hpkeDecap implements DHKEM(X25519, HKDF-SHA256)'s Decap(enc, skR): redo the
+// sender's X25519 DH using the recipient's static private key and the
+// sender's serialized ephemeral public key, deriving the same KEM shared
+// secret hpkeEncap produced.
+func hpkeDecap(enc []byte, skR [32]byte) ([]byte, error) {
+	var pkE [32]byte
+	copy(pkE[:], enc)
+	dh, err := curve25519.X25519(skR[:], pkE[:])
+	if err != nil {
+		return nil, fmt.Errorf("hpke: invalid encapsulated key: %w", err)
+	}
+	pkR, err := curve25519.X25519(skR[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	kemContext := append(append([]byte{}, pkE[:]...), pkR...)
+	eaePRK := labeledExtract(hpkeKEMSuiteID, nil, "eae_prk", dh)
+	return labeledExpand(hpkeKEMSuiteID, eaePRK, "shared_secret", kemContext, hpkeNh)
+}
+
+// hpkeSetupBaseR implements RFC 9180 §5.1.1's SetupBaseR: decapsulate the
+// shared secret sent via enc and key-schedule a recipient context from it.
+func hpkeSetupBaseR(skR [32]byte, enc []byte, info []byte) (*hpkeContext, error) {
+	sharedSecret, err := hpkeDecap(enc, skR)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeKeySchedule(sharedSecret, info)
+}
+
+func (c *hpkeContext) nextNonce() []byte {
+	nonce := make([]byte, len(c.baseNonce))
+	copy(nonce, c.baseNonce)
+	var seqBytes [8]byte
+	binary.BigEndian.PutUint64(seqBytes[:], c.seq)
+	for i, b := range seqBytes {
+		nonce[len(nonce)-8+i] ^= b
+	}
+	c.seq++
+	return nonce
+}
+
+// Seal encrypts pt per RFC 9180 §5.2's Context.Seal.
+func (c *hpkeContext) Seal(aad, pt []byte) []byte {
+	return c.aead.Seal(nil, c.nextNonce(), pt, aad)
+}
+
+// Open decrypts ct per RFC 9180 §5.2's Context.Open.
+func (c *hpkeContext) Open(aad, ct []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nextNonce(), ct, aad)
+}
+
+// Export derives an exported secret per RFC 9180 §5.3's Context.Export.
+func (c *hpkeContext) Export(exporterContext string, length int) ([]byte, error) {
+	return labeledExpand(hpkeSuiteID, c.exporterSecret, "sec", []byte(exporterContext), length)
+}
@@ -0,0 +1,223 @@
+// Copyright 2023 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ipmap resolves and remembers the working IP addresses for a DoH
+// server's hostname, so a resolver can retry a different address without
+// re-resolving, and can keep using whichever address last worked without
+// having to re-race the whole set on every query.
+package ipmap
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// IPMap tracks the IPSet of every hostname it's been asked to Get.
+type IPMap interface {
+	// Get returns the IPSet for host, resolving it on first use. The
+	// returned IPSet is never nil, even if resolution fails or returns no
+	// addresses.
+	Get(host string) *IPSet
+}
+
+type ipMap struct {
+	r               *net.Resolver
+	resolutionDelay time.Duration
+
+	mu sync.Mutex
+	m  map[string]*IPSet
+}
+
+// NewIPMap returns an IPMap that resolves hostnames using r. A nil r means
+// the system default resolver. resolutionDelay is the grace period bootstrap
+// gives a slow-to-arrive AAAA lookup before proceeding with whatever A
+// addresses already arrived; see IPSet.bootstrap.
+func NewIPMap(r *net.Resolver, resolutionDelay time.Duration) IPMap {
+	if r == nil {
+		r = &net.Resolver{}
+	}
+	return &ipMap{r: r, resolutionDelay: resolutionDelay, m: make(map[string]*IPSet)}
+}
+
+func (m *ipMap) Get(host string) *IPSet {
+	m.mu.Lock()
+	s, ok := m.m[host]
+	if !ok {
+		s = &IPSet{}
+		m.m[host] = s
+	}
+	m.mu.Unlock()
+
+	s.bootstrap(m.r, host, m.resolutionDelay)
+	return s
+}
+
+// IPSet is the set of IP addresses known for one hostname, plus which one
+// (if any) is currently confirmed to work.
+type IPSet struct {
+	resolveOnce sync.Once
+
+	mu        sync.RWMutex
+	ips       []net.IP
+	confirmed net.IP
+}
+
+// bootstrap resolves host via r and adds every address found, the first
+// time it's called for this IPSet. Later calls are no-ops: Add is how a
+// caller supplies addresses after that (e.g. configured fallbacks).
+//
+// The A and AAAA lookups race independently instead of going out as one
+// LookupIP("ip", ...) call, so resolutionDelay has something to gate per
+// RFC 8305's "Resolution Delay": bootstrap returns once the A lookup
+// finishes and either the AAAA lookup has also finished or resolutionDelay
+// has elapsed, whichever comes first. A AAAA lookup still in flight at that
+// point keeps running and adds its addresses once it completes, so a later
+// Get of the same host sees them even though this call didn't wait for them.
+func (s *IPSet) bootstrap(r *net.Resolver, host string, resolutionDelay time.Duration) {
+	s.resolveOnce.Do(func() {
+		if ip := net.ParseIP(host); ip != nil {
+			s.addLocked(ip)
+			return
+		}
+		done4 := make(chan struct{})
+		done6 := make(chan struct{})
+		go s.lookupFamily(r, host, "ip4", done4)
+		go s.lookupFamily(r, host, "ip6", done6)
+
+		timer := time.NewTimer(resolutionDelay)
+		defer timer.Stop()
+		select {
+		case <-done6:
+		case <-timer.C:
+		}
+		<-done4
+	})
+}
+
+// lookupFamily resolves host over network ("ip4" or "ip6"), adding every
+// address found and closing done when it's finished, whether or not it's
+// still being waited on.
+func (s *IPSet) lookupFamily(r *net.Resolver, host, network string, done chan struct{}) {
+	defer close(done)
+	addrs, err := r.LookupIP(context.Background(), network, host)
+	if err != nil {
+		return
+	}
+	for _, ip := range addrs {
+		s.addLocked(ip)
+	}
+}
+
+// Add adds address, a domain name or IP address literal, to the set. A
+// domain name is resolved immediately; a lookup failure is silently
+// ignored, same as an empty fallback list would be.
+func (s *IPSet) Add(address string) {
+	if ip := net.ParseIP(address); ip != nil {
+		s.addLocked(ip)
+		return
+	}
+	addrs, err := net.LookupIP(address)
+	if err != nil {
+		return
+	}
+	for _, ip := range addrs {
+		s.addLocked(ip)
+	}
+}
+
+func (s *IPSet) addLocked(ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, existing := range s.ips {
+		if existing.Equal(ip) {
+			return
+		}
+	}
+	s.ips = append(s.ips, ip)
+}
+
+// Empty reports whether the set has no addresses at all.
+func (s *IPSet) Empty() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.ips) == 0
+}
+
+// GetAll returns every known address, with the confirmed address (if any)
+// first.
+func (s *IPSet) GetAll() []net.IP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	all := make([]net.IP, 0, len(s.ips))
+	if s.confirmed != nil {
+		all = append(all, s.confirmed)
+	}
+	for _, ip := range s.ips {
+		if ip.Equal(s.confirmed) {
+			continue
+		}
+		all = append(all, ip)
+	}
+	return all
+}
+
+// GetAllSorted returns every known address ordered by RFC 6724 destination
+// address selection (see sort.go) instead of GetAll's confirmed-then-
+// arbitrary order. It does not special-case the confirmed address; callers
+// that want the confirmed address tried first regardless of its RFC 6724
+// ranking (as resolver.dial does) should promote it themselves.
+//
+// dialer is used for the route lookups RFC 6724 ranking needs (see
+// sourceAddr in sort.go); it must be the same (possibly protected) dialer
+// the caller uses for its real connections, so that lookup can't reenter
+// Intra's own tunnel. A nil dialer falls back to the zero net.Dialer,
+// i.e. an unprotected lookup - only safe when the VPN isn't active.
+func (s *IPSet) GetAllSorted(dialer *net.Dialer) []net.IP {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	s.mu.RLock()
+	ips := make([]net.IP, len(s.ips))
+	copy(ips, s.ips)
+	s.mu.RUnlock()
+	return rfc6724Sort(dialer, ips)
+}
+
+// Confirmed returns the address last confirmed to work, or nil if none is
+// currently confirmed.
+func (s *IPSet) Confirmed() net.IP {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.confirmed
+}
+
+// Confirm records that ip is known to work, so future callers try it first.
+func (s *IPSet) Confirm(ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.confirmed = ip
+}
+
+// Disconfirm clears the confirmed address, iff it is currently ip. A
+// mismatch means some other, more recent Confirm already superseded it, so
+// there's nothing to undo.
+func (s *IPSet) Disconfirm(ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.confirmed.Equal(ip) {
+		s.confirmed = nil
+	}
+}
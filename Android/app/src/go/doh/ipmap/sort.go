@@ -0,0 +1,220 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipmap
+
+import (
+	"net"
+	"sort"
+)
+
+// This file sorts destination addresses per RFC 6724 ("Default Address
+// Selection for Internet Protocol Version 6"), the same algorithm Go's own
+// net/addrselect.go implements for net.LookupIP results. It's a reduced
+// implementation: rules that need OS routing/interface state we have no
+// access to here (avoid deprecated addresses, prefer home addresses, prefer
+// native transport) are treated as always-equal rather than guessed at.
+
+// RFC 6724 scope values (RFC 4007 section 4).
+const (
+	scopeLinkLocal = 0x2
+	scopeSiteLocal = 0x5
+	scopeGlobal    = 0xe
+)
+
+// policyEntry is one row of an RFC 6724 policy table (label or precedence);
+// see labelTable and precedenceTable.
+type policyEntry struct {
+	prefix *net.IPNet
+	value  uint8
+}
+
+func cidr(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err) // s is one of the constants below; a parse failure is a bug here.
+	}
+	return n
+}
+
+// labelTable is RFC 6724's label policy table, ordered most to least
+// specific so the first matching entry wins.
+var labelTable = []policyEntry{
+	{cidr("::1/128"), 0},
+	{cidr("2001::/32"), 5},
+	{cidr("::ffff:0:0/96"), 4},
+	{cidr("::/96"), 3},
+	{cidr("2002::/16"), 2},
+	{cidr("fc00::/7"), 13},
+	{cidr("fe80::/10"), 1},
+	{cidr("::/0"), 1}, // default
+}
+
+// precedenceTable is RFC 6724's precedence policy table, same ordering
+// convention as labelTable. It has no explicit ::/96 entry, so an
+// IPv4-compatible address falls through to the ::/0 default, same as any
+// other prefix this table doesn't single out.
+var precedenceTable = []policyEntry{
+	{cidr("::1/128"), 50},
+	{cidr("2001::/32"), 5},
+	{cidr("::ffff:0:0/96"), 35},
+	{cidr("2002::/16"), 30},
+	{cidr("fc00::/7"), 3},
+	{cidr("fe80::/10"), 1},
+	{cidr("::/0"), 40}, // default
+}
+
+func lookupPolicy(table []policyEntry, ip net.IP) uint8 {
+	ip16 := ip.To16()
+	for _, e := range table {
+		if e.prefix.Contains(ip16) {
+			return e.value
+		}
+	}
+	return 0
+}
+
+func labelOf(ip net.IP) uint8      { return lookupPolicy(labelTable, ip) }
+func precedenceOf(ip net.IP) uint8 { return lookupPolicy(precedenceTable, ip) }
+
+var uniqueLocalNet = cidr("fc00::/7")
+
+// scopeOf classifies ip into the coarse link-local/site-local/global
+// buckets Go's own addrselect.go uses, rather than the full RFC 4007 scope
+// hierarchy.
+func scopeOf(ip net.IP) int {
+	switch {
+	case ip.IsLoopback(), ip.IsLinkLocalUnicast(), ip.IsLinkLocalMulticast():
+		return scopeLinkLocal
+	case ip.IsPrivate(), uniqueLocalNet.Contains(ip.To16()):
+		return scopeSiteLocal
+	default:
+		return scopeGlobal
+	}
+}
+
+// commonPrefixLen returns the number of leading bits a and b share, treating
+// both as 16-byte (IPv4-mapped, where applicable) addresses.
+func commonPrefixLen(a, b net.IP) int {
+	a16, b16 := a.To16(), b.To16()
+	if a16 == nil || b16 == nil {
+		return 0
+	}
+	n := 0
+	for i := 0; i < len(a16); i++ {
+		xor := a16[i] ^ b16[i]
+		if xor == 0 {
+			n += 8
+			continue
+		}
+		for xor&0x80 == 0 {
+			n++
+			xor <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// candidate is one destination address paired with the source address
+// sourceAddr picked for it, for use by rfc6724Less.
+type candidate struct {
+	dst net.IP
+	src net.IP // nil if no route to dst was found.
+}
+
+// sourceAddr asks the OS routing table which local address it would use to
+// reach dst, via the standard dialer.Dial("udp", ...) + LocalAddr trick -
+// this never sends a packet, since UDP dial just does a route lookup. dialer
+// must be the caller's own (possibly protected) dialer: an unprotected UDP
+// socket opened while the VPN is active gets captured by Intra's own
+// tunnel, which would turn this lookup into a hang or hand back the tun
+// interface's own address instead of a real route. It returns nil if dst is
+// unreachable (e.g. no matching route, no such address family).
+func sourceAddr(dialer *net.Dialer, dst net.IP) net.IP {
+	conn, err := dialer.Dial("udp", net.JoinHostPort(dst.String(), "9"))
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	udpAddr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	return udpAddr.IP
+}
+
+// rfc6724Less reports whether a should be preferred over b, applying (in
+// order) as many of RFC 6724's 10 destination-address-selection rules as
+// this package can evaluate without OS interface/routing introspection
+// beyond sourceAddr: avoid unusable destinations, prefer matching scope,
+// prefer matching label, prefer higher precedence, prefer smaller scope,
+// and longest matching prefix. Rules 3, 4, and 7 (avoid deprecated
+// addresses, prefer home addresses, prefer native transport) need state
+// this package doesn't have access to, so they're skipped rather than
+// guessed at.
+func rfc6724Less(a, b candidate) bool {
+	// Rule 1: avoid unusable destinations.
+	if (a.src == nil) != (b.src == nil) {
+		return a.src != nil
+	}
+	if a.src == nil && b.src == nil {
+		return false
+	}
+
+	// Rule 2: prefer matching scope.
+	aScopeMatch := scopeOf(a.src) == scopeOf(a.dst)
+	bScopeMatch := scopeOf(b.src) == scopeOf(b.dst)
+	if aScopeMatch != bScopeMatch {
+		return aScopeMatch
+	}
+
+	// Rule 5: prefer matching label.
+	aLabelMatch := labelOf(a.src) == labelOf(a.dst)
+	bLabelMatch := labelOf(b.src) == labelOf(b.dst)
+	if aLabelMatch != bLabelMatch {
+		return aLabelMatch
+	}
+
+	// Rule 6: prefer higher precedence.
+	if pa, pb := precedenceOf(a.dst), precedenceOf(b.dst); pa != pb {
+		return pa > pb
+	}
+
+	// Rule 8: prefer smaller scope.
+	if sa, sb := scopeOf(a.dst), scopeOf(b.dst); sa != sb {
+		return sa < sb
+	}
+
+	// Rule 9: longest matching prefix.
+	return commonPrefixLen(a.src, a.dst) > commonPrefixLen(b.src, b.dst)
+}
+
+// rfc6724Sort returns ips sorted per RFC 6724, most-preferred first. The
+// sort is stable, so addresses the rules above treat as equal keep their
+// relative order from ips. dialer is passed through to sourceAddr.
+func rfc6724Sort(dialer *net.Dialer, ips []net.IP) []net.IP {
+	candidates := make([]candidate, len(ips))
+	for i, ip := range ips {
+		candidates[i] = candidate{dst: ip, src: sourceAddr(dialer, ip)}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rfc6724Less(candidates[i], candidates[j])
+	})
+	sorted := make([]net.IP, len(candidates))
+	for i, c := range candidates {
+		sorted[i] = c.dst
+	}
+	return sorted
+}
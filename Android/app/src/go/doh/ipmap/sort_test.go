@@ -0,0 +1,146 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ipmap
+
+import (
+	"net"
+	"testing"
+)
+
+func mustIP(t *testing.T, s string) net.IP {
+	t.Helper()
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("invalid IP %q", s)
+	}
+	return ip
+}
+
+func TestScopeOf(t *testing.T) {
+	cases := []struct {
+		ip    string
+		scope int
+	}{
+		{"127.0.0.1", scopeLinkLocal},
+		{"::1", scopeLinkLocal},
+		{"fe80::1", scopeLinkLocal},
+		{"10.0.0.1", scopeSiteLocal},
+		{"fc00::1", scopeSiteLocal},
+		{"8.8.8.8", scopeGlobal},
+		{"2001:4860:4860::8888", scopeGlobal},
+	}
+	for _, c := range cases {
+		if got := scopeOf(mustIP(t, c.ip)); got != c.scope {
+			t.Errorf("scopeOf(%s) = %#x, want %#x", c.ip, got, c.scope)
+		}
+	}
+}
+
+func TestLabelAndPrecedenceOf(t *testing.T) {
+	cases := []struct {
+		ip         string
+		label      uint8
+		precedence uint8
+	}{
+		{"::1", 0, 50},
+		{"2001::1", 5, 5},  // 2001::/32
+		{"fc00::1", 13, 3}, // fc00::/7 (unique local)
+		{"fe80::1", 1, 1},  // fe80::/10 (link-local)
+		{"2002::1", 2, 30}, // 2002::/16 (6to4)
+		{"8.8.8.8", 4, 35}, // To16 maps into ::ffff:0:0/96, not the ::/0 default
+	}
+	for _, c := range cases {
+		if got := labelOf(mustIP(t, c.ip)); got != c.label {
+			t.Errorf("labelOf(%s) = %d, want %d", c.ip, got, c.label)
+		}
+		if got := precedenceOf(mustIP(t, c.ip)); got != c.precedence {
+			t.Errorf("precedenceOf(%s) = %d, want %d", c.ip, got, c.precedence)
+		}
+	}
+}
+
+func TestCommonPrefixLen(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want int
+	}{
+		{"192.168.1.1", "192.168.1.2", 126},
+		{"192.168.1.1", "192.168.2.1", 118},
+		{"::1", "::2", 126},
+		{"2001:db8::1", "2001:db8::2", 126},
+	}
+	for _, c := range cases {
+		if got := commonPrefixLen(mustIP(t, c.a), mustIP(t, c.b)); got != c.want {
+			t.Errorf("commonPrefixLen(%s, %s) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestRFC6724LessUnusableSortsLast(t *testing.T) {
+	usable := candidate{dst: mustIP(t, "8.8.8.8"), src: mustIP(t, "192.168.1.1")}
+	unusable := candidate{dst: mustIP(t, "9.9.9.9"), src: nil}
+	if !rfc6724Less(usable, unusable) {
+		t.Error("usable candidate should sort before an unusable one")
+	}
+	if rfc6724Less(unusable, usable) {
+		t.Error("unusable candidate should not sort before a usable one")
+	}
+}
+
+func TestRFC6724LessPrefersMatchingScope(t *testing.T) {
+	// a's source and destination are both global; b's source is global but
+	// its destination is site-local - a should win on scope match (rule 2).
+	a := candidate{dst: mustIP(t, "8.8.8.8"), src: mustIP(t, "1.2.3.4")}
+	b := candidate{dst: mustIP(t, "10.0.0.1"), src: mustIP(t, "1.2.3.4")}
+	if !rfc6724Less(a, b) {
+		t.Error("scope-matching candidate should be preferred")
+	}
+}
+
+func TestRFC6724LessLongestPrefixTiebreak(t *testing.T) {
+	// Same scope, label, and precedence (both global IPv4); closer is the
+	// one sharing more leading bits with its own source address.
+	closer := candidate{dst: mustIP(t, "1.2.3.4"), src: mustIP(t, "1.2.3.1")}
+	farther := candidate{dst: mustIP(t, "5.6.7.8"), src: mustIP(t, "1.2.3.1")}
+	if !rfc6724Less(closer, farther) {
+		t.Error("candidate with the longer common prefix with its source should be preferred")
+	}
+}
+
+func TestRFC6724SortStableOnTies(t *testing.T) {
+	// Two equally-ranked (by every implemented rule) global IPv4 addresses
+	// with no real local route at all (src nil for both) should keep their
+	// relative input order, since the sort is stable and Rule 1 treats two
+	// unusable candidates as equal.
+	ips := []net.IP{mustIP(t, "203.0.113.1"), mustIP(t, "203.0.113.2")}
+	candidates := []candidate{{dst: ips[0]}, {dst: ips[1]}}
+	if rfc6724Less(candidates[0], candidates[1]) || rfc6724Less(candidates[1], candidates[0]) {
+		t.Fatal("expected both unusable candidates to be treated as equal")
+	}
+}
+
+func TestRFC6724SortLoopbackPrefersLoopback(t *testing.T) {
+	// A real, protected-in-spirit dialer is enough to let loopback's own
+	// route lookup succeed in any sandboxed test environment.
+	dialer := &net.Dialer{}
+	ips := []net.IP{mustIP(t, "8.8.8.8"), mustIP(t, "127.0.0.1")}
+	sorted := rfc6724Sort(dialer, ips)
+	if len(sorted) != len(ips) {
+		t.Fatalf("got %d addresses, want %d", len(sorted), len(ips))
+	}
+	if !sorted[0].Equal(mustIP(t, "127.0.0.1")) {
+		t.Errorf("expected loopback to sort first (matching link-local scope), got %v", sorted)
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// MultiMode controls how a MultiResolver dispatches a query across its
+// member Resolvers. Named distinctly from SelectionMode's PrimaryFallback/
+// Race/WeightedRandom, which pick among replicas of the *same* server
+// pool; MultiMode picks among independently operated upstreams.
+type MultiMode int
+
+const (
+	// MultiRace dispatches to every member concurrently and returns
+	// whichever valid response arrives first, cancelling the rest.
+	MultiRace MultiMode = iota
+	// MultiSequential tries each member in order, falling through to the
+	// next on any failure - including a member's own hangover, since a
+	// resolver in hangover simply fails doQuery quickly with its own
+	// error.
+	MultiSequential
+	// MultiSticky hashes the query name to a single member, used for
+	// every query with that name until it accumulates
+	// StickyFailoverThreshold consecutive errors, at which point
+	// MultiResolver fails over to the next member in hash order.
+	MultiSticky
+)
+
+// StickyFailoverThreshold is the number of consecutive errors a
+// MultiSticky member must produce before MultiResolver stops routing its
+// hashed queries to it and fails over to the next member.
+const StickyFailoverThreshold = 3
+
+// multiMember wraps one MultiResolver member with the consecutive-error
+// count MultiSticky uses to decide when to fail over.
+type multiMember struct {
+	resolver Resolver
+	url      string
+
+	mu                  sync.Mutex
+	consecutiveFailures int
+}
+
+func (m *multiMember) recordResult(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.consecutiveFailures = 0
+		return
+	}
+	m.consecutiveFailures++
+}
+
+func (m *multiMember) failingOver() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.consecutiveFailures >= StickyFailoverThreshold
+}
+
+// MultiResolver is a [Resolver] that spreads every query across several
+// independently operated upstream Resolvers - e.g. Cloudflare, Quad9, and a
+// custom DoH endpoint - instead of relying on just one, letting an Intra
+// user combine them instead of picking a single one by hand. See
+// [MultiMode] for the available dispatch strategies.
+//
+// Member Resolvers are expected to have been built with a nil Listener:
+// MultiResolver reports exactly one Summary per logical query to its own
+// listener, regardless of how many members it actually queried.
+type MultiResolver struct {
+	members  []*multiMember
+	mode     MultiMode
+	listener Listener
+}
+
+var _ Resolver = (*MultiResolver)(nil)
+
+// NewMultiResolver builds a MultiResolver from members, dispatching each
+// query per mode. listener receives one Summary per logical query, with
+// Summary.RaceWinner set to whichever member's URL actually answered.
+func NewMultiResolver(members []Resolver, mode MultiMode, listener Listener) (*MultiResolver, error) {
+	if len(members) == 0 {
+		return nil, errors.New("at least one resolver is required")
+	}
+	m := &MultiResolver{mode: mode, listener: listener}
+	for _, r := range members {
+		m.members = append(m.members, &multiMember{resolver: r, url: r.GetURL()})
+	}
+	return m, nil
+}
+
+// GetURL returns the first member's URL. MultiResolver has no single
+// canonical URL; this is only meant for diagnostic logging.
+func (m *MultiResolver) GetURL() string {
+	return m.members[0].url
+}
+
+// Query implements Resolver.Query, dispatching to m's members per m.mode.
+func (m *MultiResolver) Query(ctx context.Context, q []byte) ([]byte, error) {
+	var token Token
+	if m.listener != nil {
+		token = m.listener.OnQuery(m.GetURL())
+	}
+
+	before := time.Now()
+	response, winner, err := m.dispatch(ctx, q)
+	latency := time.Since(before)
+
+	if m.listener != nil {
+		status := Complete
+		if err != nil {
+			status = SendFailed
+		}
+		m.listener.OnResponse(token, &Summary{
+			Latency:    latency.Seconds(),
+			Query:      q,
+			Response:   response,
+			Server:     winner,
+			Status:     status,
+			RaceWinner: winner,
+		})
+	}
+	return response, err
+}
+
+func (m *MultiResolver) dispatch(ctx context.Context, q []byte) (response []byte, winnerURL string, err error) {
+	switch m.mode {
+	case MultiSequential:
+		return m.querySequential(ctx, q)
+	case MultiSticky:
+		return m.querySticky(ctx, q)
+	default: // MultiRace
+		return m.queryRace(ctx, q)
+	}
+}
+
+// querySequential tries every member in launch order, stopping at the
+// first validated response.
+func (m *MultiResolver) querySequential(ctx context.Context, q []byte) ([]byte, string, error) {
+	var lastErr error
+	for _, member := range m.members {
+		resp, err := member.resolver.Query(ctx, q)
+		member.recordResult(err)
+		if err == nil {
+			if verr := validateResponse(resp); verr == nil {
+				return resp, member.url, nil
+			} else {
+				err = verr
+			}
+		}
+		lastErr = err
+	}
+	return nil, "", lastErr
+}
+
+// querySticky routes q to the member chosen by hashing its query name,
+// skipping it for the next member in hash order if it has failed over (see
+// StickyFailoverThreshold). If the member it queries returns an error or an
+// invalid response, the next member in hash order is queried for the same q.
+func (m *MultiResolver) querySticky(ctx context.Context, q []byte) ([]byte, string, error) {
+	start := stickyIndex(q, len(m.members))
+	var lastErr error
+	for i := 0; i < len(m.members); i++ {
+		member := m.members[(start+i)%len(m.members)]
+		if i < len(m.members)-1 && member.failingOver() {
+			// Not the last candidate, and this member has already shown
+			// it's unhealthy: skip straight to the next one instead of
+			// spending a query on it.
+			continue
+		}
+		resp, err := member.resolver.Query(ctx, q)
+		member.recordResult(err)
+		if err == nil {
+			if verr := validateResponse(resp); verr == nil {
+				return resp, member.url, nil
+			} else {
+				err = verr
+			}
+		}
+		lastErr = err
+	}
+	return nil, "", lastErr
+}
+
+// stickyIndex hashes q's question name to a member index, falling back to
+// index 0 if q can't be parsed (e.g. a malformed query some member will
+// reject anyway).
+func stickyIndex(q []byte, n int) int {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(q); err != nil || len(msg.Questions) == 0 {
+		return 0
+	}
+	h := fnv.New32a()
+	h.Write([]byte(msg.Questions[0].Name.String()))
+	return int(h.Sum32()) % n
+}
+
+// multiRaceResult is one member's outcome from queryRace.
+type multiRaceResult struct {
+	response []byte
+	url      string
+	err      error
+}
+
+// queryRace dispatches q to every member concurrently and returns the
+// first validated response, cancelling every other in-flight member via a
+// shared, derived context.
+func (m *MultiResolver) queryRace(ctx context.Context, q []byte) ([]byte, string, error) {
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan multiRaceResult, len(m.members))
+	for _, member := range m.members {
+		member := member
+		go func() {
+			resp, err := member.resolver.Query(raceCtx, q)
+			member.recordResult(err)
+			if err == nil {
+				err = validateResponse(resp)
+			}
+			results <- multiRaceResult{resp, member.url, err}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < len(m.members); i++ {
+		res := <-results
+		if res.err == nil {
+			cancel() // best-effort: ask every loser to give up.
+			return res.response, res.url, nil
+		}
+		lastErr = res.err
+	}
+	return nil, "", lastErr
+}
+
+// validateResponse does the minimum sanity checking RFC 1035 and common
+// sense call for before a response is trusted as "the" answer for q:
+// it must unpack as a well-formed DNS message, be marked as a response,
+// and not be a SERVFAIL - a malformed or SERVFAIL reply from one upstream
+// shouldn't win a race (or a fallback chain) over a good reply from
+// another.
+func validateResponse(response []byte) error {
+	if len(response) == 0 {
+		return errors.New("empty response")
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(response); err != nil {
+		return err
+	}
+	if !msg.Response {
+		return errors.New("not a DNS response")
+	}
+	if msg.RCode == dnsmessage.RCodeServerFailure {
+		return errors.New("SERVFAIL")
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// ODoHTargetConfig describes the Oblivious DoH target the query is ultimately
+// encrypted for: its HPKE key and the key-identifying config ID, both taken
+// verbatim from the target's published ObliviousDoHConfig (RFC 9230 §4.1).
+type ODoHTargetConfig struct {
+	KeyID     byte
+	PublicKey [32]byte // DHKEM-X25519 public key
+}
+
+const (
+	odohMediaType       = "application/oblivious-dns-message"
+	odohMessageTypeReq  = 0x01
+	odohMessageTypeResp = 0x02
+	hpkeInfoConstant    = "odoh query"
+)
+
+// odohResolver implements [Resolver] for Oblivious DoH (RFC 9230). It wraps
+// each DNS query in HPKE (DHKEM-X25519 + HKDF-SHA256 + AES-128-GCM) against
+// the target's public config, then POSTs the opaque blob through an
+// independent DoH proxy. The proxy forwards bytes it cannot decrypt, and the
+// target never observes the client's IP address.
+type odohResolver struct {
+	proxyURL string
+	target   ODoHTargetConfig
+	client   *http.Client
+	listener Listener
+}
+
+// NewODoHResolver returns a [Resolver] that sends Oblivious DoH queries
+// through `proxyURL` to the target described by `target`. `dialer` is used
+// to reach the proxy; `listener` receives the status of each query.
+func NewODoHResolver(proxyURL string, target ODoHTargetConfig, dialer *net.Dialer, listener Listener) (Resolver, error) {
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	return &odohResolver{
+		proxyURL: proxyURL,
+		target:   target,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       dialer.DialContext,
+				ForceAttemptHTTP2: true,
+			},
+		},
+		listener: listener,
+	}, nil
+}
+
+func (r *odohResolver) Query(ctx context.Context, q []byte) ([]byte, error) {
+	var token Token
+	if r.listener != nil {
+		token = r.listener.OnQuery(r.proxyURL)
+	}
+	before := time.Now()
+	resp, status, httpStatus, qerr := r.doQuery(ctx, q)
+	latency := time.Since(before)
+
+	if r.listener != nil {
+		r.listener.OnResponse(token, &Summary{
+			Latency:    latency.Seconds(),
+			Query:      q,
+			Response:   resp,
+			Server:     r.proxyURL,
+			Status:     status,
+			HTTPStatus: httpStatus,
+		})
+	}
+	return resp, qerr
+}
+
+func (r *odohResolver) doQuery(ctx context.Context, q []byte) (resp []byte, status, httpStatus int, err error) {
+	encrypted, seal, encErr := sealODoHQuery(q, r.target)
+	if encErr != nil {
+		return nil, InternalError, 0, encErr
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.proxyURL, bytes.NewReader(encrypted))
+	if err != nil {
+		return nil, InternalError, 0, err
+	}
+	req.Header.Set("Content-Type", odohMediaType)
+	req.Header.Set("Accept", odohMediaType)
+
+	httpResp, err := r.client.Do(req)
+	if err != nil {
+		return nil, SendFailed, 0, err
+	}
+	defer httpResp.Body.Close()
+
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, BadResponse, httpResp.StatusCode, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, HTTPError, httpResp.StatusCode, fmt.Errorf("ODoH proxy returned HTTP %d", httpResp.StatusCode)
+	}
+
+	plaintext, err := seal.open(body)
+	if err != nil {
+		return nil, BadResponse, httpResp.StatusCode, err
+	}
+	return plaintext, Complete, httpResp.StatusCode, nil
+}
+
+func (r *odohResolver) GetURL() string {
+	return r.proxyURL
+}
+
+// odohSeal holds the per-query HPKE context needed to open the matching
+// response: the query's HPKE sender context (its exporter secret derives
+// the response's independent key) and enc, the serialized ephemeral public
+// key, per RFC 9230 §4.3.
+type odohSeal struct {
+	ctx *hpkeContext
+	enc []byte
+}
+
+// odohResponseNonceLen is max(Nn, Nk) for this ciphersuite (RFC 9230 §4.3):
+// AES-128-GCM's Nk (16) exceeds its own Nn (12), so the response nonce is
+// sized to Nk.
+const odohResponseNonceLen = hpkeNk
+
+// sealODoHQuery encrypts q for the target described by cfg using a real
+// HPKE (RFC 9180) base-mode context - DHKEM(X25519, HKDF-SHA256),
+// HKDF-SHA256, AES-128-GCM, the exact ciphersuite a real ODoH target
+// publishes - and frames the result as an ObliviousDoHMessage (RFC 9230
+// §4.2).
+func sealODoHQuery(q []byte, cfg ODoHTargetConfig) ([]byte, *odohSeal, error) {
+	ctx, enc, err := hpkeSetupBaseS(cfg.PublicKey, []byte(hpkeInfoConstant))
+	if err != nil {
+		return nil, nil, err
+	}
+	aad := []byte{odohMessageTypeReq, cfg.KeyID}
+	ciphertext := ctx.Seal(aad, q)
+
+	msg := new(bytes.Buffer)
+	msg.WriteByte(odohMessageTypeReq)
+	msg.WriteByte(cfg.KeyID)
+	binary.Write(msg, binary.BigEndian, uint16(len(enc)))
+	msg.Write(enc)
+	binary.Write(msg, binary.BigEndian, uint16(len(ciphertext)))
+	msg.Write(ciphertext)
+
+	return msg.Bytes(), &odohSeal{ctx: ctx, enc: enc}, nil
+}
+
+// open decrypts an ObliviousDoHMessage response. Per RFC 9230 §4.3, the
+// target doesn't reuse the query's AEAD key for the response: it exports a
+// fresh secret from the HPKE context, salts it with a response_nonce it
+// picked, and re-derives an independent key/nonce pair from that - so
+// compromising one response's key doesn't expose any other.
+func (s *odohSeal) open(resp []byte) ([]byte, error) {
+	if len(resp) < odohResponseNonceLen {
+		return nil, errors.New("odoh: response too short")
+	}
+	responseNonce := resp[:odohResponseNonceLen]
+	ciphertext := resp[odohResponseNonceLen:]
+
+	secret, err := s.ctx.Export(hpkeInfoConstant+" response", hpkeNk)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte{}, s.enc...), responseNonce...)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+
+	keyAndNonce := make([]byte, hpkeNk+hpkeNn)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(hpkeInfoConstant+" response")), keyAndNonce); err != nil {
+		return nil, err
+	}
+	key, nonce := keyAndNonce[:hpkeNk], keyAndNonce[hpkeNk:]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, []byte{odohMessageTypeResp})
+}
@@ -0,0 +1,275 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// sealMockODoHResponse plays the target's side of RFC 9230 §4.3's response
+// re-keying, mirroring odohSeal.open exactly, so TestODoHRoundTrip can
+// verify sealODoHQuery/open against an independent implementation of the
+// same derivation rather than against itself.
+func sealMockODoHResponse(t *testing.T, seal *odohSeal, plaintext []byte) []byte {
+	t.Helper()
+	responseNonce := make([]byte, odohResponseNonceLen)
+	if _, err := rand.Read(responseNonce); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+
+	secret, err := seal.ctx.Export(hpkeInfoConstant+" response", hpkeNk)
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	salt := append(append([]byte{}, seal.enc...), responseNonce...)
+	prk := hkdf.Extract(sha256.New, secret, salt)
+
+	keyAndNonce := make([]byte, hpkeNk+hpkeNn)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte(hpkeInfoConstant+" response")), keyAndNonce); err != nil {
+		t.Fatalf("Expand: %v", err)
+	}
+	key, nonce := keyAndNonce[:hpkeNk], keyAndNonce[hpkeNk:]
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("NewCipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("NewGCM: %v", err)
+	}
+	ciphertext := aead.Seal(nil, nonce, plaintext, []byte{odohMessageTypeResp})
+	return append(responseNonce, ciphertext...)
+}
+
+// TestODoHRoundTrip seals a query for a mock target, has the mock target
+// decrypt it and seal a response per RFC 9230 §4.3's independent response
+// re-keying, and checks the client's open recovers the original plaintext.
+// See hpke.go and odoh.go for the reasoning behind the derivation it
+// exercises.
+func TestODoHRoundTrip(t *testing.T) {
+	pk, sk, err := generateX25519KeyPair()
+	if err != nil {
+		t.Fatalf("generateX25519KeyPair: %v", err)
+	}
+	cfg := ODoHTargetConfig{KeyID: 7, PublicKey: pk}
+	query := []byte("\x00\x00\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00\x03www\x07example\x03com\x00\x00\x01\x00\x01")
+
+	encrypted, seal, err := sealODoHQuery(query, cfg)
+	if err != nil {
+		t.Fatalf("sealODoHQuery: %v", err)
+	}
+
+	// Play the target: parse the ObliviousDoHMessage, redo the DH with its
+	// static private key, and recover the query.
+	if encrypted[0] != odohMessageTypeReq || encrypted[1] != cfg.KeyID {
+		t.Fatalf("unexpected message header: %x", encrypted[:2])
+	}
+	encLen := binary.BigEndian.Uint16(encrypted[2:4])
+	enc := encrypted[4 : 4+encLen]
+	ctLen := binary.BigEndian.Uint16(encrypted[4+encLen : 6+encLen])
+	ciphertext := encrypted[6+encLen : 6+encLen+ctLen]
+
+	targetCtx, err := hpkeSetupBaseR(sk, enc, []byte(hpkeInfoConstant))
+	if err != nil {
+		t.Fatalf("hpkeSetupBaseR: %v", err)
+	}
+	aad := []byte{odohMessageTypeReq, cfg.KeyID}
+	decrypted, err := targetCtx.Open(aad, ciphertext)
+	if err != nil {
+		t.Fatalf("target Open: %v", err)
+	}
+	if !bytes.Equal(decrypted, query) {
+		t.Fatalf("target recovered %q, want %q", decrypted, query)
+	}
+
+	// The target's response must be re-keyed from the same exporter
+	// secret, so it has to be sealed via the client's own seal (the
+	// client and target share the same HPKE context, just as a real DH
+	// run would give the target an equivalent context to targetCtx; here
+	// we reuse seal.ctx directly since this test's goal is to exercise
+	// the response re-keying, not re-derive SetupBaseR's symmetry).
+	reply := []byte("reply payload")
+	resp := sealMockODoHResponse(t, seal, reply)
+
+	got, err := seal.open(resp)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if !bytes.Equal(got, reply) {
+		t.Fatalf("open recovered %q, want %q", got, reply)
+	}
+}
+
+// TestODoHOpenRejectsCorruption checks that flipping a ciphertext bit in a
+// sealed response makes open fail, rather than silently returning garbage.
+func TestODoHOpenRejectsCorruption(t *testing.T) {
+	pk, _, err := generateX25519KeyPair()
+	if err != nil {
+		t.Fatalf("generateX25519KeyPair: %v", err)
+	}
+	cfg := ODoHTargetConfig{KeyID: 1, PublicKey: pk}
+	_, seal, err := sealODoHQuery([]byte("query"), cfg)
+	if err != nil {
+		t.Fatalf("sealODoHQuery: %v", err)
+	}
+
+	resp := sealMockODoHResponse(t, seal, []byte("reply"))
+	resp[len(resp)-1] ^= 0xff
+	if _, err := seal.open(resp); err == nil {
+		t.Fatal("open of a corrupted response should fail")
+	}
+}
+
+func buildSignedCertForTest(t *testing.T, providerPk ed25519.PublicKey, providerSk ed25519.PrivateKey, serverPk [32]byte, notBefore, notAfter uint32) []byte {
+	t.Helper()
+	signed := make([]byte, 32+8+4+4+4)
+	copy(signed[:32], serverPk[:])
+	copy(signed[32:40], clientMagic[:])
+	binary.BigEndian.PutUint32(signed[40:44], 1) // serial
+	binary.BigEndian.PutUint32(signed[44:48], notBefore)
+	binary.BigEndian.PutUint32(signed[48:52], notAfter)
+
+	sig := ed25519.Sign(providerSk, signed)
+
+	cert := make([]byte, 0, dnscryptCertFixedLen)
+	cert = append(cert, dnscryptCertMagic...)
+	cert = append(cert, 0, byte(esVersionXChaCha20Poly1305)) // es-version
+	cert = append(cert, 0, 0)                                // protocol-minor-version
+	cert = append(cert, sig...)
+	cert = append(cert, signed...)
+	return cert
+}
+
+func buildTXTResponseForTest(t *testing.T, name string, certBlobs ...[]byte) []byte {
+	t.Helper()
+	var msg dnsmessage.Message
+	msg.Header.Response = true
+	q := dnsmessage.Question{
+		Name:  dnsmessage.MustNewName(name),
+		Type:  dnsmessage.TypeTXT,
+		Class: dnsmessage.ClassINET,
+	}
+	msg.Questions = []dnsmessage.Question{q}
+	for _, blob := range certBlobs {
+		var strs []string
+		for len(blob) > 255 {
+			strs = append(strs, string(blob[:255]))
+			blob = blob[255:]
+		}
+		strs = append(strs, string(blob))
+		msg.Answers = append(msg.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name:  q.Name,
+				Type:  dnsmessage.TypeTXT,
+				Class: dnsmessage.ClassINET,
+			},
+			Body: &dnsmessage.TXTResource{TXT: strs},
+		})
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	return packed
+}
+
+func TestParseCertTXTResponseVerifiesSignature(t *testing.T) {
+	providerPk, providerSk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	var providerPkArr [32]byte
+	copy(providerPkArr[:], providerPk)
+	var serverPk [32]byte
+	if _, err := rand.Read(serverPk[:]); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+
+	cert := buildSignedCertForTest(t, providerPk, providerSk, serverPk, 100, 200)
+	resp := buildTXTResponseForTest(t, "example.com.", cert)
+
+	got, err := parseCertTXTResponse(resp, providerPkArr)
+	if err != nil {
+		t.Fatalf("parseCertTXTResponse: %v", err)
+	}
+	if got.serverPk != serverPk || got.notBefore != 100 || got.notAfter != 200 {
+		t.Errorf("parsed cert = %+v, want serverPk=%x notBefore=100 notAfter=200", got, serverPk)
+	}
+}
+
+func TestParseCertTXTResponseRejectsForgedSignature(t *testing.T) {
+	_, providerSk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	// attackerPk is NOT the provider's key: a forged cert signed with the
+	// wrong key must be rejected.
+	attackerPk, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	var attackerPkArr [32]byte
+	copy(attackerPkArr[:], attackerPk)
+
+	var serverPk [32]byte
+	cert := buildSignedCertForTest(t, attackerPk, providerSk, serverPk, 100, 200)
+	resp := buildTXTResponseForTest(t, "example.com.", cert)
+
+	// Verify against a different, unrelated provider key than the one the
+	// forged cert was actually signed with.
+	var wrongProviderPk [32]byte
+	if _, err := rand.Read(wrongProviderPk[:]); err != nil {
+		t.Fatalf("rand.Read: %v", err)
+	}
+	if _, err := parseCertTXTResponse(resp, wrongProviderPk); err == nil {
+		t.Fatal("expected a cert signed by an unrelated key to be rejected")
+	}
+}
+
+func TestParseCertTXTResponsePicksLatestExpiry(t *testing.T) {
+	providerPk, providerSk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	var providerPkArr [32]byte
+	copy(providerPkArr[:], providerPk)
+
+	var oldPk, newPk [32]byte
+	rand.Read(oldPk[:])
+	rand.Read(newPk[:])
+	oldCert := buildSignedCertForTest(t, providerPk, providerSk, oldPk, 100, 200)
+	newCert := buildSignedCertForTest(t, providerPk, providerSk, newPk, 100, 300)
+	resp := buildTXTResponseForTest(t, "example.com.", oldCert, newCert)
+
+	got, err := parseCertTXTResponse(resp, providerPkArr)
+	if err != nil {
+		t.Fatalf("parseCertTXTResponse: %v", err)
+	}
+	if got.serverPk != newPk {
+		t.Errorf("expected the cert with the later notAfter to win, got serverPk=%x want %x", got.serverPk, newPk)
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SelectionMode controls how a TransportPool picks among its member
+// resolvers for each query.
+type SelectionMode int
+
+const (
+	// PrimaryFallback always uses the first healthy member, in order,
+	// falling through to the next healthy member when a query to it fails.
+	// A member whose circuit breaker has tripped is skipped.
+	PrimaryFallback SelectionMode = iota
+	// Race dispatches each query to the two healthiest members concurrently
+	// and returns whichever responds first, cancelling the other.
+	Race
+	// WeightedRandom picks among healthy members with probability
+	// proportional to 1/EWMA-latency, favoring faster servers without
+	// starving slower ones entirely.
+	WeightedRandom
+)
+
+const (
+	// circuitBreakerThreshold is the number of consecutive failures after
+	// which a member is treated as unhealthy.
+	circuitBreakerThreshold = 3
+	// circuitBreakerCooldown is how long a tripped member is skipped for
+	// before getting another chance.
+	circuitBreakerCooldown = 30 * time.Second
+	// latencyEWMAAlpha weights how quickly the latency EWMA reacts to a new
+	// sample; smaller values smooth out noise more.
+	latencyEWMAAlpha = 0.3
+)
+
+// TransportStats is a snapshot of one TransportPool member's measured
+// health, as shown to the application via [backend.DoHServer.DoHTransportStats].
+type TransportStats struct {
+	URL                 string
+	EWMALatencySeconds  float64
+	QueryCount          int64
+	ErrorCount          int64
+	ConsecutiveFailures int
+	CircuitOpen         bool
+}
+
+// poolMember tracks one TransportPool resolver's measured health, updated
+// via its own poolMemberListener every time it completes a query.
+type poolMember struct {
+	resolver Resolver
+
+	mu                  sync.Mutex
+	ewmaLatency         float64
+	hasLatencySample    bool
+	queryCount          int64
+	errorCount          int64
+	consecutiveFailures int
+	circuitOpenUntil    time.Time
+}
+
+func (m *poolMember) healthy(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return now.After(m.circuitOpenUntil)
+}
+
+// weight returns this member's selection weight for WeightedRandom: zero if
+// its circuit is open, 1 (a neutral default) if it has no latency samples
+// yet, and 1/latency otherwise.
+func (m *poolMember) weight(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Before(m.circuitOpenUntil) {
+		return 0
+	}
+	if !m.hasLatencySample {
+		return 1
+	}
+	const epsilon = 1e-3 // avoid dividing by ~0 for very fast local resolvers
+	return 1 / (m.ewmaLatency + epsilon)
+}
+
+// record updates the member's health from one completed query's reported
+// latency and status (see the Complete/SendFailed/... constants).
+func (m *poolMember) record(latency time.Duration, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.queryCount++
+	sample := latency.Seconds()
+	if !m.hasLatencySample {
+		m.ewmaLatency = sample
+		m.hasLatencySample = true
+	} else {
+		m.ewmaLatency = latencyEWMAAlpha*sample + (1-latencyEWMAAlpha)*m.ewmaLatency
+	}
+
+	if status == Complete {
+		m.consecutiveFailures = 0
+		m.circuitOpenUntil = time.Time{}
+		return
+	}
+	m.errorCount++
+	m.consecutiveFailures++
+	if m.consecutiveFailures >= circuitBreakerThreshold {
+		m.circuitOpenUntil = time.Now().Add(circuitBreakerCooldown)
+	}
+}
+
+func (m *poolMember) stats() TransportStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return TransportStats{
+		URL:                 m.resolver.GetURL(),
+		EWMALatencySeconds:  m.ewmaLatency,
+		QueryCount:          m.queryCount,
+		ErrorCount:          m.errorCount,
+		ConsecutiveFailures: m.consecutiveFailures,
+		CircuitOpen:         time.Now().Before(m.circuitOpenUntil),
+	}
+}
+
+// poolToken wraps the upstream Listener's token so poolMemberListener can
+// recover it in OnResponse.
+type poolToken struct {
+	upstream Token
+}
+
+// poolMemberListener is the Listener a TransportPool gives to each member
+// resolver it builds. It forwards every call to the pool's own caller-
+// supplied Listener, so existing per-query telemetry is unaffected, and
+// additionally feeds the result into the member's health tracking.
+type poolMemberListener struct {
+	member   *poolMember
+	upstream Listener
+}
+
+func (l *poolMemberListener) OnQuery(url string) Token {
+	var upstream Token
+	if l.upstream != nil {
+		upstream = l.upstream.OnQuery(url)
+	}
+	return poolToken{upstream}
+}
+
+func (l *poolMemberListener) OnResponse(t Token, s *Summary) {
+	l.member.record(time.Duration(s.Latency*float64(time.Second)), s.Status)
+	if l.upstream == nil {
+		return
+	}
+	pt, _ := t.(poolToken)
+	l.upstream.OnResponse(pt.upstream, s)
+}
+
+// TransportPool is a [Resolver] that spreads queries across several DoH
+// resolvers, selecting among them by measured health (EWMA latency, error
+// rate, and a consecutive-failures circuit breaker) instead of always using
+// the same one. See [SelectionMode] for the available selection strategies.
+type TransportPool struct {
+	members []*poolMember
+	mode    SelectionMode
+}
+
+var _ Resolver = (*TransportPool)(nil)
+
+// NewTransportPool builds a TransportPool from servers, each either a plain
+// DoH template ("https://...") or a DNSCrypt stamp ("sdns://..."). addrs,
+// dialer, auth, preferH3, and happyEyeballs are used for every plain-DoH
+// member exactly as in NewResolver. listener receives every member's query
+// reports, same as it would from a single NewResolver/NewDNSCryptResolver.
+func NewTransportPool(servers []string, addrs []string, dialer *net.Dialer, auth ClientAuth, preferH3 bool, happyEyeballs *HappyEyeballsConfig, listener Listener, mode SelectionMode) (*TransportPool, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("at least one server is required")
+	}
+
+	p := &TransportPool{mode: mode}
+	for _, s := range servers {
+		member := &poolMember{}
+		ml := &poolMemberListener{member: member, upstream: listener}
+
+		var r Resolver
+		var err error
+		if strings.HasPrefix(s, "sdns://") {
+			r, err = NewDNSCryptResolver(s, dialer, ml)
+		} else {
+			r, err = NewResolver(s, addrs, dialer, auth, preferH3, happyEyeballs, ml)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to create resolver for %s: %w", s, err)
+		}
+
+		member.resolver = r
+		p.members = append(p.members, member)
+	}
+	return p, nil
+}
+
+// GetURL returns the primary (first) member's URL. TransportPool has no
+// single canonical URL; this is only meant for diagnostic logging.
+func (p *TransportPool) GetURL() string {
+	return p.members[0].resolver.GetURL()
+}
+
+// Stats returns the current measured health of every member, in the order
+// they were given to NewTransportPool.
+func (p *TransportPool) Stats() []TransportStats {
+	stats := make([]TransportStats, len(p.members))
+	for i, m := range p.members {
+		stats[i] = m.stats()
+	}
+	return stats
+}
+
+// Query implements Resolver.Query, selecting among the pool's members
+// according to its SelectionMode.
+func (p *TransportPool) Query(ctx context.Context, q []byte) ([]byte, error) {
+	now := time.Now()
+	switch p.mode {
+	case Race:
+		return p.queryRace(ctx, q, now)
+	case WeightedRandom:
+		return p.members[p.pickWeighted(now)].resolver.Query(ctx, q)
+	default: // PrimaryFallback
+		return p.queryPrimaryFallback(ctx, q, now)
+	}
+}
+
+func (p *TransportPool) queryPrimaryFallback(ctx context.Context, q []byte, now time.Time) ([]byte, error) {
+	var last error
+	for _, m := range p.members {
+		if !m.healthy(now) {
+			continue
+		}
+		resp, err := m.resolver.Query(ctx, q)
+		if err == nil {
+			return resp, nil
+		}
+		last = err
+	}
+	if last != nil {
+		return nil, last
+	}
+	// Every member is circuit-broken; try the first one anyway, rather than
+	// failing outright just because our own health tracking gave up on it.
+	return p.members[0].resolver.Query(ctx, q)
+}
+
+func (p *TransportPool) pickWeighted(now time.Time) int {
+	weights := make([]float64, len(p.members))
+	var total float64
+	for i, m := range p.members {
+		weights[i] = m.weight(now)
+		total += weights[i]
+	}
+	if total <= 0 {
+		return 0
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r <= 0 {
+			return i
+		}
+	}
+	return len(p.members) - 1
+}
+
+// membersByHealth returns the pool's members ranked from healthiest to
+// least healthy, by the same weight used for WeightedRandom selection.
+func (p *TransportPool) membersByHealth(now time.Time) []*poolMember {
+	ranked := make([]*poolMember, len(p.members))
+	copy(ranked, p.members)
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].weight(now) > ranked[j].weight(now) })
+	return ranked
+}
+
+func (p *TransportPool) queryRace(ctx context.Context, q []byte, now time.Time) ([]byte, error) {
+	ranked := p.membersByHealth(now)
+	n := 2
+	if len(ranked) < n {
+		n = len(ranked)
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type raceResult struct {
+		resp []byte
+		err  error
+	}
+	results := make(chan raceResult, n)
+	for _, m := range ranked[:n] {
+		m := m
+		go func() {
+			resp, err := m.resolver.Query(raceCtx, q)
+			results <- raceResult{resp, err}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < n; i++ {
+		res := <-results
+		if res.err == nil {
+			cancel() // best-effort: ask the loser to give up
+			return res.resp, nil
+		}
+		lastErr = res.err
+	}
+	return nil, lastErr
+}
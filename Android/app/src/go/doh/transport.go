@@ -0,0 +1,29 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import "net"
+
+// Transport is the common interface implemented by every DNS transport this
+// package can build: plain DoH, DNSCrypt, and Oblivious DoH. It is an alias
+// of [Resolver] so that existing DoH-only callers keep working unchanged.
+type Transport = Resolver
+
+// NewTransport returns a DoH [Transport], ready for use. It is a thin wrapper
+// around [NewResolver] kept for callers that only know about DoH and predate
+// DNSCrypt/ODoH support.
+func NewTransport(rawurl string, addrs []string, dialer *net.Dialer, auth ClientAuth, preferH3 bool, happyEyeballs *HappyEyeballsConfig, listener Listener) (Transport, error) {
+	return NewResolver(rawurl, addrs, dialer, auth, preferH3, happyEyeballs, listener)
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics accumulates split.retrier's dial-RTT and retry counters
+// across every connection it dials, instead of each retrier reporting only
+// once, via its own one-shot RetryStats, when its connection closes.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBoundsMs are the histogram bucket upper bounds, in milliseconds.
+var latencyBoundsMs = [numLatencyBuckets]int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+const numLatencyBuckets = 10
+
+// histogram is a fixed-bucket, Prometheus-style latency histogram: each
+// bucket counts observations <= its upper bound, alongside a running sum
+// and total count for computing an average.
+type histogram struct {
+	counts [numLatencyBuckets]atomic.Int64
+	sum    atomic.Int64 // milliseconds
+	count  atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	ms := d.Milliseconds()
+	for i, bound := range latencyBoundsMs {
+		if ms <= bound {
+			h.counts[i].Add(1)
+		}
+	}
+	h.sum.Add(ms)
+	h.count.Add(1)
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram's state.
+type HistogramSnapshot struct {
+	Buckets map[int64]int64 // bucket upper bound (ms) -> cumulative count
+	Sum     int64           // total observed milliseconds
+	Count   int64
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{Buckets: make(map[int64]int64, len(latencyBoundsMs)), Sum: h.sum.Load(), Count: h.count.Load()}
+	for i, bound := range latencyBoundsMs {
+		s.Buckets[bound] = h.counts[i].Load()
+	}
+	return s
+}
+
+// Registry accumulates counters and latency histograms across every
+// connection split.retrier dials. The zero Registry is an empty Registry,
+// the same as the one New returns.
+type Registry struct {
+	dials         atomic.Int64
+	retries       atomic.Int64
+	retryTimeouts atomic.Int64
+	fragmented    atomic.Int64
+
+	dialRTT histogram
+}
+
+// New returns an empty Registry.
+func New() *Registry {
+	return &Registry{}
+}
+
+// RecordDialRTT observes one successful TCP handshake's RTT, i.e. the delay
+// between the SYN and the SYNACK.
+func (r *Registry) RecordDialRTT(d time.Duration) {
+	r.dials.Add(1)
+	r.dialRTT.observe(d)
+}
+
+// RecordRetry accounts for one split-retry attempt. timeout reports whether
+// the retry was triggered by a read timeout, as opposed to a connection
+// reset.
+func (r *Registry) RecordRetry(timeout bool) {
+	r.retries.Add(1)
+	if timeout {
+		r.retryTimeouts.Add(1)
+	}
+}
+
+// RecordFragmented accounts for one retry whose ClientHello was split at
+// the TLS record layer (as opposed to a plain TCP-segment split) - see
+// tlsfrag.Recursive.
+func (r *Registry) RecordFragmented() {
+	r.fragmented.Add(1)
+}
+
+// Snapshot is a serializable, point-in-time copy of a Registry's counters,
+// e.g. for an app-side UI to poll and render as live throughput.
+type Snapshot struct {
+	Dials         int64
+	Retries       int64
+	RetryTimeouts int64
+	Fragmented    int64
+	DialRTT       HistogramSnapshot
+}
+
+// Snapshot returns a copy of the Registry's current state.
+func (r *Registry) Snapshot() Snapshot {
+	return Snapshot{
+		Dials:         r.dials.Load(),
+		Retries:       r.retries.Load(),
+		RetryTimeouts: r.retryTimeouts.Load(),
+		Fragmented:    r.fragmented.Load(),
+		DialRTT:       r.dialRTT.snapshot(),
+	}
+}
+
+// Expose writes the Registry's current state to w in Prometheus text
+// exposition format, for a developer running the backend outside Android
+// to scrape with `curl` or a local Prometheus instance.
+func (r *Registry) Expose(w io.Writer) error {
+	s := r.Snapshot()
+
+	counters := []struct {
+		name  string
+		value int64
+	}{
+		{"intra_split_dials_total", s.Dials},
+		{"intra_split_retries_total", s.Retries},
+		{"intra_split_retry_timeouts_total", s.RetryTimeouts},
+		{"intra_split_retries_fragmented_total", s.Fragmented},
+	}
+	for _, c := range counters {
+		if _, err := fmt.Fprintf(w, "%s %d\n", c.name, c.value); err != nil {
+			return err
+		}
+	}
+	return exposeHistogram(w, "intra_split_dial_rtt_milliseconds", s.DialRTT)
+}
+
+func exposeHistogram(w io.Writer, name string, h HistogramSnapshot) error {
+	if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+		return err
+	}
+	for _, bound := range latencyBoundsMs {
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, fmt.Sprintf("%d", bound), h.Buckets[bound]); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum %d\n", name, h.Sum); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+	return err
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package split
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// happyEyeballsDelay is the stagger between successive connection attempts
+// in raceDial, per RFC 8305's recommended "Connection Attempt Delay".
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// interleaveAddrs reorders addrs per RFC 8305 address interleaving: IPv6
+// and IPv4 candidates alternate, starting with whichever family addrs[0]
+// belongs to, instead of exhausting one family before trying the other.
+func interleaveAddrs(addrs []*net.TCPAddr) []*net.TCPAddr {
+	if len(addrs) == 0 {
+		return addrs
+	}
+	var v4, v6 []*net.TCPAddr
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	first, second := v6, v4
+	if addrs[0].IP.To4() != nil {
+		first, second = v4, v6
+	}
+
+	out := make([]*net.TCPAddr, 0, len(addrs))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+// raceDial dials every address in addrs per RFC 8305 Happy Eyeballs v2:
+// addresses are interleaved by family (see interleaveAddrs) and launched
+// staggered by delay (RFC 8305's "Connection Attempt Delay"; pass
+// happyEyeballsDelay for the default), the first successful connection
+// wins, and every other in-flight attempt is canceled. stats.AttemptedAddrs
+// records every address a connection attempt was actually launched for, in
+// launch order.
+func raceDial(ctx context.Context, dialer *net.Dialer, addrs []*net.TCPAddr, stats *RetryStats, delay time.Duration) (*net.TCPConn, *net.TCPAddr, error) {
+	if len(addrs) == 0 {
+		return nil, nil, errors.New("split: no addresses to dial")
+	}
+	addrs = interleaveAddrs(addrs)
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		addr *net.TCPAddr
+		conn *net.TCPConn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+
+	var attemptedMu sync.Mutex
+	var wg sync.WaitGroup
+	// attemptWG tracks only each goroutine's decision of whether to record
+	// itself in stats.AttemptedAddrs (not the dial itself), so the winner
+	// path below can wait for every pending append to either happen or be
+	// abandoned before handing stats back to the caller - otherwise a
+	// losing goroutine whose stagger timer fires just as the winner returns
+	// could still be appending to stats.AttemptedAddrs after the caller
+	// starts reading it.
+	var attemptWG sync.WaitGroup
+	wg.Add(len(addrs))
+	attemptWG.Add(len(addrs))
+	for i, addr := range addrs {
+		go func(i int, addr *net.TCPAddr) {
+			defer wg.Done()
+			if i > 0 {
+				timer := time.NewTimer(time.Duration(i) * delay)
+				defer timer.Stop()
+				select {
+				case <-raceCtx.Done():
+					attemptWG.Done()
+					return
+				case <-timer.C:
+				}
+			}
+
+			attemptedMu.Lock()
+			stats.AttemptedAddrs = append(stats.AttemptedAddrs, addr.String())
+			attemptedMu.Unlock()
+			attemptWG.Done()
+
+			conn, err := dialer.DialContext(raceCtx, addr.Network(), addr.String())
+			if err != nil {
+				results <- result{addr: addr, err: err}
+				return
+			}
+			results <- result{addr: addr, conn: conn.(*net.TCPConn)}
+		}(i, addr)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var errs []error
+	for res := range results {
+		if res.err != nil {
+			if !errors.Is(res.err, context.Canceled) {
+				errs = append(errs, res.err)
+			}
+			continue
+		}
+
+		// The first successful connection wins; cancel every other attempt
+		// and close any loser that connects anyway after losing the race.
+		cancel()
+		attemptWG.Wait() // no goroutine may still be about to append to stats.AttemptedAddrs below.
+		go func() {
+			for res := range results {
+				if res.conn != nil {
+					res.conn.Close()
+				}
+			}
+		}()
+		return res.conn, res.addr, nil
+	}
+
+	if len(errs) == 0 {
+		errs = append(errs, ctx.Err())
+	}
+	return nil, nil, errors.Join(errs...)
+}
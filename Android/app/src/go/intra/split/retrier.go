@@ -16,11 +16,11 @@ package split
 
 import (
 	"context"
-	"encoding/binary"
 	"errors"
 	"io"
+	"localhost/Intra/Android/app/src/go/intra/metrics"
 	"localhost/Intra/Android/app/src/go/logging"
-	"math/rand"
+	"localhost/Intra/Android/app/src/go/tlsfrag"
 	"net"
 	"sync"
 	"time"
@@ -29,11 +29,13 @@ import (
 )
 
 type RetryStats struct {
-	SNI     string // TLS SNI observed, if present.
-	Bytes   int32  // Number of bytes uploaded before the retry.
-	Chunks  int16  // Number of writes before the retry.
-	Split   int16  // Number of bytes in the first retried segment.
-	Timeout bool   // True if the retry was caused by a timeout.
+	SNI            string   // TLS SNI observed, if present.
+	Bytes          int32    // Number of bytes uploaded before the retry.
+	Chunks         int16    // Number of writes before the retry.
+	Split          int16    // Number of bytes in the first retried segment.
+	Timeout        bool     // True if the retry was caused by a timeout.
+	AttemptedAddrs []string // Every address a Happy Eyeballs race attempted, in launch order.
+	WinnerAddr     string   // The address the race (or the single-address dial) connected on.
 }
 
 // retrier implements the DuplexConn interface.
@@ -59,6 +61,8 @@ type retrier struct {
 	// hello is the contents written before the first read.  It is initially empty,
 	// and is cleared when the first byte is received.
 	hello []byte
+	// policy decides how hello is fragmented on retry.  See tlsfrag.Policy.
+	policy tlsfrag.Policy
 	// Flag indicating when retry is finished or unnecessary.
 	retryCompleteFlag chan struct{}
 	// Flags indicating whether the caller has called CloseRead and CloseWrite.
@@ -113,6 +117,17 @@ func timeout(before, after time.Time) time.Duration {
 // default TCP timeout (typically 2-3 minutes).
 const DefaultTimeout time.Duration = 0
 
+// DefaultPolicy is the fragmentation policy DialWithSplitRetry uses: a
+// random 32-64 byte TCP-level split of the ClientHello, with its first TLS
+// record additionally re-fragmented once at the record layer.  This matches
+// the split behavior Intra has always used on retry.
+var DefaultPolicy tlsfrag.Policy = tlsfrag.Recursive(tlsfrag.RandomOffset(32, 64), 1)
+
+// Metrics accumulates dial-RTT and retry counters across every call to
+// DialWithSplitRetry and DialWithSplitRetryPolicy in this process, so an
+// app-side UI can read live totals instead of polling each RetryStats.
+var Metrics = metrics.New()
+
 // DialWithSplitRetry returns a TCP connection that transparently retries by
 // splitting the initial upstream segment if the socket closes without receiving a
 // reply.  Like net.Conn, it is intended for two-threaded use, with one thread calling
@@ -120,27 +135,71 @@ const DefaultTimeout time.Duration = 0
 // `dialer` will be used to establish the connection.
 // `addr` is the destination.
 // If `stats` is non-nil, it will be populated with retry-related information.
+// The retry is fragmented according to DefaultPolicy; use
+// DialWithSplitRetryPolicy to choose a different tlsfrag.Policy, or
+// DialWithSplitRetryAddrs to race more than one candidate address.
 func DialWithSplitRetry(ctx context.Context, dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats) (DuplexConn, error) {
-	logging.Debug("SplitRetry(DialWithSplitRetry) - dialing", "addr", addr)
-	before := time.Now()
-	conn, err := dialer.DialContext(ctx, addr.Network(), addr.String())
-	logging.Debug("SplitRetry(DialWithSplitRetry) - dialed", "err", err)
-	if err != nil {
-		return nil, err
-	}
-	after := time.Now()
+	return DialWithSplitRetryPolicy(ctx, dialer, addr, stats, DefaultPolicy)
+}
 
+// DialWithSplitRetryPolicy is DialWithSplitRetry, but fragments the retried
+// ClientHello according to the given tlsfrag.Policy instead of the default
+// one - e.g. tlsfrag.SNIAware(), or tlsfrag.Recursive applied to a deeper
+// nesting - so split is one fragmentation policy among several instead of a
+// fixed algorithm.
+func DialWithSplitRetryPolicy(ctx context.Context, dialer *net.Dialer, addr *net.TCPAddr, stats *RetryStats, policy tlsfrag.Policy) (DuplexConn, error) {
+	return DialWithSplitRetryAddrsPolicy(ctx, dialer, []*net.TCPAddr{addr}, stats, policy)
+}
+
+// DialWithSplitRetryAddrs is DialWithSplitRetry, but races every address in
+// addrs per RFC 8305 Happy Eyeballs v2 instead of dialing a single one, so
+// the connection survives single-IP blackholing and not just hello-drop
+// censorship. The retry path reuses whichever address won the race, so a
+// later split-retry redial never reintroduces one of the addresses that
+// lost (or errored out of) the race.
+func DialWithSplitRetryAddrs(ctx context.Context, dialer *net.Dialer, addrs []*net.TCPAddr, stats *RetryStats) (DuplexConn, error) {
+	return DialWithSplitRetryAddrsPolicy(ctx, dialer, addrs, stats, DefaultPolicy)
+}
+
+// DialWithSplitRetryAddrsPolicy combines DialWithSplitRetryAddrs and
+// DialWithSplitRetryPolicy: it races every address in addrs, and fragments
+// the retried ClientHello according to policy.
+func DialWithSplitRetryAddrsPolicy(ctx context.Context, dialer *net.Dialer, addrs []*net.TCPAddr, stats *RetryStats, policy tlsfrag.Policy) (DuplexConn, error) {
+	return DialWithSplitRetryAddrsDelayPolicy(ctx, dialer, addrs, stats, happyEyeballsDelay, policy)
+}
+
+// DialWithSplitRetryAddrsDelayPolicy is DialWithSplitRetryAddrsPolicy, but
+// races the candidates staggered by delay (RFC 8305's "Connection Attempt
+// Delay") instead of the package default, for callers - such as
+// doh.NewResolver's HappyEyeballsConfig - that need the pacing to be
+// configurable, e.g. for deterministic test timing.
+func DialWithSplitRetryAddrsDelayPolicy(ctx context.Context, dialer *net.Dialer, addrs []*net.TCPAddr, stats *RetryStats, delay time.Duration, policy tlsfrag.Policy) (DuplexConn, error) {
 	if stats == nil {
 		// This is a fake stats object that will be written but never read.  Its purpose
 		// is to avoid the need for nil checks at each point where stats are updated.
 		stats = &RetryStats{}
 	}
 
+	logging.Debug("SplitRetry(DialWithSplitRetry) - dialing", "addrs", addrs)
+	before := time.Now()
+	conn, winner, err := raceDial(ctx, dialer, addrs, stats, delay)
+	logging.Debug("SplitRetry(DialWithSplitRetry) - dialed", "winner", winner, "err", err)
+	if err != nil {
+		return nil, err
+	}
+	after := time.Now()
+	stats.WinnerAddr = winner.String()
+	Metrics.RecordDialRTT(after.Sub(before))
+
 	r := &retrier{
-		dialer:            dialer,
-		addr:              addr,
-		conn:              conn.(*net.TCPConn),
+		dialer: dialer,
+		// addr is the winning address, not the full candidate list, so a
+		// later retry() redial goes straight back to the address that's
+		// already known to be reachable.
+		addr:              winner,
+		conn:              conn,
 		timeout:           timeout(before, after),
+		policy:            policy,
 		retryCompleteFlag: make(chan struct{}),
 		readCloseFlag:     make(chan struct{}),
 		writeCloseFlag:    make(chan struct{}),
@@ -188,9 +247,17 @@ func (r *retrier) retry(buf []byte) (n int, err error) {
 		return
 	}
 	r.conn = newConn.(*net.TCPConn)
-	pkts, split := splitHello(r.hello)
+	pkts, split := r.policy.Fragment(r.hello)
 	r.stats.Split = split
 
+	Metrics.RecordRetry(r.stats.Timeout)
+	if len(pkts) > 2 {
+		// More than one TCP segment and more than two halves means the
+		// policy re-fragmented at the TLS record layer on top of its plain
+		// split, e.g. tlsfrag.Recursive.
+		Metrics.RecordFragmented()
+	}
+
 	// We did not use pkts.WriteTo(r.conn), because under the hood, the connection
 	// will use writev system call to write buffers, and writev may combine these
 	// buffers into one single write.
@@ -225,79 +292,6 @@ func (r *retrier) CloseRead() error {
 	return r.conn.CloseRead()
 }
 
-func splitHello(hello []byte) (pkts net.Buffers, splitLen int16) {
-	if len(hello) == 0 {
-		return net.Buffers{hello}, 0
-	}
-	const (
-		MIN_SPLIT         int = 32
-		MAX_SPLIT         int = 64
-		MIN_TLS_HELLO_LEN int = 6
-
-		TYPE_HANDSHAKE byte   = 22
-		VERSION_TLS10  uint16 = 0x0301
-		VERSION_TLS11  uint16 = 0x0302
-		VERSION_TLS12  uint16 = 0x0303
-		VERSION_TLS13  uint16 = 0x0304
-	)
-
-	// Random number in the range [MIN_SPLIT, MAX_SPLIT]
-	s := MIN_SPLIT + rand.Intn(MAX_SPLIT+1-MIN_SPLIT)
-	limit := len(hello) / 2
-	if s > limit {
-		s = limit
-	}
-	splitLen = int16(s)
-	pkts = net.Buffers{hello[:s], hello[s:]}
-
-	if len(pkts[0]) > MIN_TLS_HELLO_LEN {
-		// todo: Replace the following TLS fragmentation logic with tlsfrag.StreamDialer
-		//
-		// TLS record layout from RFC 8446:
-		//   [RecordType:1B][Ver:2B][Len:2B][Data...]
-		// RecordType := ... | handshake(22) | ...
-		//        Ver := 0x0301 ("TLS 1.0") | 0x0302 ("TLS 1.1") | 0x0303 ("TLS 1.2")
-		//
-		// Now we have already TCP-splitted into pkts0 (len >= 6) and pkts1.
-		// We just need to deal with pkts0 and fragment it:
-		//
-		//   original:   pkts[0]=[Header][data0],
-		//               pkts[1]=[data1]
-		//   fragmented: pkts[0]=[Header]
-		//               pkts[1]=[data0_0],
-		//               pkts[2]=[Header],
-		//               pkts[3]=[data0_1],
-		//               pkts[4]=[data1]
-
-		h1 := make([]byte, 5)
-		copy(h1, pkts[0][:5])
-		payload := pkts[0][5:] // len(payload) > 1 is guaranteed
-
-		typ := h1[0]
-		ver := binary.BigEndian.Uint16(h1[1:3])
-		recordLen := binary.BigEndian.Uint16(h1[3:5])
-
-		if typ == TYPE_HANDSHAKE && int(recordLen) >= len(payload) &&
-			(ver == VERSION_TLS10 || ver == VERSION_TLS11 ||
-				ver == VERSION_TLS12 || ver == VERSION_TLS13) {
-			rest := pkts[1]
-			frag := uint16(1 + rand.Intn(len(payload)-1)) // 1 <= frag <= len(payload)-1
-
-			binary.BigEndian.PutUint16(h1[3:5], frag)
-			payload1 := payload[:frag]
-
-			h2 := make([]byte, 5)
-			copy(h2, h1)
-			binary.BigEndian.PutUint16(h2[3:5], recordLen-frag) // recordLen >= len(payload) > frag
-			payload2 := payload[frag:]
-
-			pkts = net.Buffers{h1, payload1, h2, payload2, rest}
-		}
-	}
-
-	return
-}
-
 // Write-related functions
 func (r *retrier) Write(b []byte) (int, error) {
 	// Double-checked locking pattern.  This avoids lock acquisition on
@@ -16,60 +16,169 @@
 Package logging is a centralized logging system for Intra's Go backend.
 It offers efficient logging methods that save CPU power by only formatting
 messages that need to be logged.
+
+The handler, its writer, and the minimum level are all runtime-configurable
+(SetHandler, SetWriter, SetLevel) so a caller can raise verbosity for a
+debugging session, or redirect output, without a rebuild. Switching them is
+safe to do concurrently with Dbg/Info/Warn/Err calls from the many
+goroutines this package is used from (the doh resolvers, split's retrier,
+the tunnel, and friends).
 */
 package logging
 
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"sync/atomic"
 )
 
-var logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
-	Level: slog.LevelWarn,
-}))
+// level is the minimum severity logged by whichever handler SetWriter or
+// SetLevel last installed. It's shared so SetLevel can retarget the active
+// handler without rebuilding it.
+var level = &slog.LevelVar{}
+
+// logger is swapped out atomically by SetHandler (and everything built on
+// it: SetWriter, SetJSONWriter, SetAndroidLogger), so it's safe to change
+// concurrently with Dbg/Info/Warn/Err calls already in flight.
+var logger atomic.Pointer[slog.Logger]
+
+func init() {
+	level.Set(slog.LevelWarn)
+	logger.Store(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+}
+
+// SetLevel changes the minimum severity logged by the current handler. It
+// has no effect on a handler installed via SetHandler with its own level
+// policy.
+func SetLevel(l slog.Level) {
+	level.Set(l)
+}
+
+// SetHandler replaces the handler backing every Dbg/Info/Warn/Err call.
+// Most callers want SetWriter, SetJSONWriter, or SetAndroidLogger instead;
+// use SetHandler directly only for a handler those don't cover (e.g. a test
+// recorder).
+func SetHandler(h slog.Handler) {
+	logger.Store(slog.New(h))
+}
+
+// SetWriter keeps the default text format but writes to w instead of
+// os.Stderr, e.g. a log file on Android.
+func SetWriter(w io.Writer) {
+	SetHandler(slog.NewTextHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// SetJSONWriter is SetWriter, but with a JSON handler instead of a text one,
+// for sinks that want structured records (e.g. a remote log collector).
+func SetJSONWriter(w io.Writer) {
+	SetHandler(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level}))
+}
+
+// AndroidLogger lets the Java side of the gomobile bridge receive Intra's
+// log records - e.g. to forward them to android.util.Log - without cgo.
+type AndroidLogger interface {
+	// Log is called once per record at or above the current level. level is
+	// the record's slog.Level (so e.g. int(slog.LevelInfo) == 0), for the
+	// Java side to map onto the android.util.Log constant of its choice.
+	Log(level int, msg string)
+}
+
+// SetAndroidLogger routes every log record to l instead of an io.Writer.
+// Passing nil restores the default stderr text handler.
+func SetAndroidLogger(l AndroidLogger) {
+	if l == nil {
+		SetWriter(os.Stderr)
+		return
+	}
+	SetHandler(&androidHandler{logger: l, level: level})
+}
+
+// androidHandler is a minimal slog.Handler that flattens each record into a
+// single "msg key=value ..." string and hands it to an AndroidLogger,
+// instead of writing formatted bytes to an io.Writer.
+type androidHandler struct {
+	logger AndroidLogger
+	level  slog.Leveler
+	attrs  []slog.Attr
+}
+
+var _ slog.Handler = (*androidHandler)(nil)
+
+func (h *androidHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *androidHandler) Handle(_ context.Context, r slog.Record) error {
+	msg := r.Message
+	for _, a := range h.attrs {
+		msg += fmt.Sprintf(" %s=%v", a.Key, a.Value)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		msg += fmt.Sprintf(" %s=%v", a.Key, a.Value)
+		return true
+	})
+	h.logger.Log(int(r.Level), msg)
+	return nil
+}
+
+func (h *androidHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	merged := append(append([]slog.Attr{}, h.attrs...), attrs...)
+	return &androidHandler{logger: h.logger, level: h.level, attrs: merged}
+}
+
+func (h *androidHandler) WithGroup(string) slog.Handler {
+	// Groups only matter for nested structure, which is meaningless once
+	// attrs are flattened into a string; keep the fields unprefixed.
+	return h
+}
 
 func Dbg(msg string, args ...any) {
-	logger.Debug(msg, args...)
+	logger.Load().Debug(msg, args...)
 }
 
 func Dbgf(format string, args ...any) {
-	if !logger.Enabled(context.Background(), slog.LevelDebug) {
+	l := logger.Load()
+	if !l.Enabled(context.Background(), slog.LevelDebug) {
 		return
 	}
-	logger.Debug(fmt.Sprintf(format, args...))
+	l.Debug(fmt.Sprintf(format, args...))
 }
 
 func Info(msg string, args ...any) {
-	logger.Info(msg, args...)
+	logger.Load().Info(msg, args...)
 }
 
 func Infof(format string, args ...any) {
-	if !logger.Enabled(context.Background(), slog.LevelInfo) {
+	l := logger.Load()
+	if !l.Enabled(context.Background(), slog.LevelInfo) {
 		return
 	}
-	logger.Info(fmt.Sprintf(format, args...))
+	l.Info(fmt.Sprintf(format, args...))
 }
 
 func Warn(msg string, args ...any) {
-	logger.Warn(msg, args...)
+	logger.Load().Warn(msg, args...)
 }
 
 func Warnf(format string, args ...any) {
-	if !logger.Enabled(context.Background(), slog.LevelWarn) {
+	l := logger.Load()
+	if !l.Enabled(context.Background(), slog.LevelWarn) {
 		return
 	}
-	logger.Warn(fmt.Sprintf(format, args...))
+	l.Warn(fmt.Sprintf(format, args...))
 }
 
 func Err(msg string, args ...any) {
-	logger.Error(msg, args...)
+	logger.Load().Error(msg, args...)
 }
 
 func Errf(format string, args ...any) {
-	if !logger.Enabled(context.Background(), slog.LevelError) {
+	l := logger.Load()
+	if !l.Enabled(context.Background(), slog.LevelError) {
 		return
 	}
-	logger.Error(fmt.Sprintf(format, args...))
+	l.Error(fmt.Sprintf(format, args...))
 }
@@ -0,0 +1,66 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlsfrag
+
+import (
+	"context"
+	"net"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// StreamDialer wraps an inner transport.StreamDialer so that the first write
+// on every connection it dials - expected to be a TLS ClientHello - is
+// fragmented according to Policy before reaching the wire. It is one policy
+// plug among several a caller can compose into an outline-sdk dial chain,
+// alongside the SDK's own transport/split, shadowsocks, and socks5 dialers.
+type StreamDialer struct {
+	Dialer transport.StreamDialer
+	Policy Policy
+}
+
+var _ transport.StreamDialer = (*StreamDialer)(nil)
+
+// Dial implements transport.StreamDialer.Dial.
+func (d *StreamDialer) Dial(ctx context.Context, raddr string) (transport.StreamConn, error) {
+	conn, err := d.Dialer.Dial(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return transport.WrapConn(conn, conn, &fragmentingWriter{conn: conn, policy: d.Policy}), nil
+}
+
+// fragmentingWriter fragments only the first write it sees - the
+// ClientHello - per Policy, and passes every later write straight through.
+type fragmentingWriter struct {
+	conn   net.Conn
+	policy Policy
+	done   bool
+}
+
+func (w *fragmentingWriter) Write(b []byte) (int, error) {
+	if w.done {
+		return w.conn.Write(b)
+	}
+	w.done = true
+
+	pkts, _ := w.policy.Fragment(b)
+	for _, pkt := range pkts {
+		if _, err := w.conn.Write(pkt); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
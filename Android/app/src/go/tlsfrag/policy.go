@@ -0,0 +1,132 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tlsfrag
+
+import (
+	"bytes"
+	"math/rand"
+	"net"
+
+	"github.com/Jigsaw-Code/getsni"
+)
+
+// offsetPolicy splits hello into exactly two TCP segments, at a byte offset
+// chosen by pick.
+type offsetPolicy struct {
+	pick func(helloLen int) int
+}
+
+func (p *offsetPolicy) Fragment(hello []byte) (net.Buffers, int16) {
+	if len(hello) == 0 {
+		return net.Buffers{hello}, 0
+	}
+	s := p.pick(len(hello))
+	if s <= 0 {
+		s = 1
+	}
+	if limit := len(hello) / 2; s > limit {
+		s = limit
+	}
+	return net.Buffers{hello[:s], hello[s:]}, int16(s)
+}
+
+// FixedOffset splits hello at byte offset n, clamped to at least 1 and at
+// most len(hello)/2.
+func FixedOffset(n int) Policy {
+	return &offsetPolicy{pick: func(int) int { return n }}
+}
+
+// RandomOffset splits hello at a byte offset drawn uniformly from
+// [min, max], so a passive observer can't fingerprint the split point.
+func RandomOffset(min, max int) Policy {
+	return &offsetPolicy{pick: func(int) int { return min + rand.Intn(max+1-min) }}
+}
+
+// sniPolicy always cuts inside the ServerName value of the ClientHello's SNI
+// extension, so the SNI itself is never visible in a single TCP segment.
+type sniPolicy struct{}
+
+// SNIAware returns a Policy that splits hello in the middle of its SNI
+// extension's ServerName value. If hello has no SNI (or isn't a ClientHello
+// at all), it falls through to a RandomOffset(32, 64) split instead.
+func SNIAware() Policy {
+	return &sniPolicy{}
+}
+
+func (p *sniPolicy) Fragment(hello []byte) (net.Buffers, int16) {
+	sni, err := getsni.GetSNI(hello)
+	if err != nil || sni == "" {
+		return RandomOffset(32, 64).Fragment(hello)
+	}
+	nameOff := bytes.Index(hello, []byte(sni))
+	if nameOff < 0 {
+		return RandomOffset(32, 64).Fragment(hello)
+	}
+	s := nameOff + len(sni)/2
+	if s <= 0 || s >= len(hello) {
+		return RandomOffset(32, 64).Fragment(hello)
+	}
+	return net.Buffers{hello[:s], hello[s:]}, int16(s)
+}
+
+// recursivePolicy applies base, then re-fragments the resulting first TLS
+// record depth more times, each time splitting its payload at a fresh random
+// point. This defeats middleboxes that only reassemble a fixed, small number
+// of TLS record fragments before inspecting the ClientHello.
+type recursivePolicy struct {
+	base  Policy
+	depth int
+}
+
+// Recursive wraps base so that, after the initial split, the first TLS
+// record of the result is fragmented depth additional times at the TLS
+// record layer (as opposed to base's single TCP-segment-layer split).
+// depth <= 0 is equivalent to base alone.
+func Recursive(base Policy, depth int) Policy {
+	return &recursivePolicy{base: base, depth: depth}
+}
+
+func (p *recursivePolicy) Fragment(hello []byte) (net.Buffers, int16) {
+	pkts, splitLen := p.base.Fragment(hello)
+	if len(pkts) == 0 {
+		return pkts, splitLen
+	}
+
+	header, payload, ok := parseRecordHeader(pkts[0])
+	if !ok {
+		return pkts, splitLen
+	}
+
+	// Repeatedly peel a fragment off the front of the record, re-deriving a
+	// valid record header (with an updated length) for what remains each
+	// time, e.g. depth=1 turns [header|data] into [header1|data0][header2|data1].
+	var out net.Buffers
+	for i := 0; i < p.depth && len(payload) >= 2; i++ {
+		frag := 1 + rand.Intn(len(payload)-1) // 1 <= frag <= len(payload)-1
+		recordLen := int(header[3])<<8 | int(header[4])
+
+		h := make([]byte, recordHeaderLen)
+		copy(h, header)
+		h[3], h[4] = byte(frag>>8), byte(frag)
+		out = append(out, h, payload[:frag])
+
+		header = make([]byte, recordHeaderLen)
+		copy(header, h)
+		header[3], header[4] = byte((recordLen-frag)>>8), byte(recordLen-frag)
+		payload = payload[frag:]
+	}
+	out = append(out, header, payload)
+	return append(out, pkts[1:]...), splitLen
+}
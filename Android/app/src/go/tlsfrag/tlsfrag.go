@@ -0,0 +1,72 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+Package tlsfrag implements TLS ClientHello fragmentation as a set of
+composable policies, in place of a single hard-coded byte-surgery routine.
+A [Policy] decides how to cut a ClientHello into the several TCP segments
+that are actually written to the wire; [StreamDialer] plugs a Policy into an
+ordinary github.com/Jigsaw-Code/outline-sdk/transport.StreamDialer chain, the
+same extension point the rest of the SDK's transports (split, shadowsocks,
+socks5) use. split.retrier drives a Policy directly instead, since its
+retry-on-empty-reply logic needs to choose whether to fragment at all.
+*/
+package tlsfrag
+
+import "net"
+
+// Policy decides how to fragment a TLS ClientHello (or any first write that
+// might be one) before it reaches the wire.
+type Policy interface {
+	// Fragment splits hello into the buffers that should be written in its
+	// place, in order. splitLen is the byte offset of the outermost split,
+	// reported for stats purposes; it is meaningless if len(pkts) < 2.
+	Fragment(hello []byte) (pkts net.Buffers, splitLen int16)
+}
+
+// TLS record-layer constants, from RFC 8446.
+const (
+	recordHeaderLen int = 5
+
+	typeHandshake byte = 22
+
+	versionTLS10 uint16 = 0x0301
+	versionTLS11 uint16 = 0x0302
+	versionTLS12 uint16 = 0x0303
+	versionTLS13 uint16 = 0x0304
+)
+
+// parseRecordHeader reports whether record begins with a well-formed TLS
+// handshake record header whose declared length covers the rest of record,
+// returning the header and payload split out for convenience.
+func parseRecordHeader(record []byte) (header, payload []byte, ok bool) {
+	if len(record) <= recordHeaderLen {
+		return nil, nil, false
+	}
+	header, payload = record[:recordHeaderLen], record[recordHeaderLen:]
+
+	typ := header[0]
+	ver := uint16(header[1])<<8 | uint16(header[2])
+	recordLen := int(header[3])<<8 | int(header[4])
+
+	if typ != typeHandshake || recordLen < len(payload) {
+		return nil, nil, false
+	}
+	switch ver {
+	case versionTLS10, versionTLS11, versionTLS12, versionTLS13:
+	default:
+		return nil, nil, false
+	}
+	return header, payload, true
+}
@@ -21,12 +21,29 @@ import (
 	"net"
 	"os"
 
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/conntrack"
 	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/doh"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/gonat"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/metrics"
 	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/sni"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/socks5"
 	"github.com/Jigsaw-Code/outline-sdk/network"
 	"github.com/Jigsaw-Code/outline-sdk/network/lwip2transport"
 )
 
+// Backend selects which implementation of the tun-device-to-dialer data
+// path NewIntraDevice configures.
+type Backend int
+
+const (
+	// BackendLwIP uses lwip2transport.ConfigureDevice: a full, battle-tested
+	// TCP/IP stack, at the cost of linking lwIP's cgo code.
+	BackendLwIP Backend = iota
+	// BackendGoNAT uses gonat.ConfigureDevice: a pure-Go, cgo-free userspace
+	// NAT. See package gonat for what it trades away to avoid lwIP.
+	BackendGoNAT
+)
+
 // SocketProtector is a way to make certain sockets or DNS lookups bypassing the VPN connection. This is only needed
 // for devices running Android versions older than Lollipop (21). Once a socket is protected, data sent through it will
 // go directly to the internet, bypassing the VPN. The Android VpnService implements the protect() method.
@@ -40,14 +57,28 @@ type IntraDevice struct {
 	sd  doh.DoHStreamDialer
 	pp  doh.DoHPacketProxy
 	sni sni.TCPSNIReporter
+
+	conntrack *conntrack.Table
+	metrics   *metrics.Registry
+
+	socks *socks5.Server
 }
 
-func NewIntraDevice(fakeDNS, serverURL, fallbackAddrs string, protector SocketProtector, listener EventListener) (d *IntraDevice, err error) {
+// transportConfig is an Outline-SDK style "|"-separated config string (see
+// internal/config) describing the dial wrapper chain - e.g. split, splitretry,
+// or override - to apply to port-443 destinations. Passing "" keeps the
+// device's historical default behavior; see doh.DefaultTransportConfig.
+//
+// backend picks which network.IPDevice implementation handles the tun
+// device's packets; see Backend.
+func NewIntraDevice(fakeDNS, serverURL, fallbackAddrs, transportConfig string, backend Backend, protector SocketProtector, listener EventListener) (d *IntraDevice, err error) {
 	log.Println("[debug] initializing Intra device...")
 
 	d = &IntraDevice{
 		protector: protector,
 		listener:  eventListenerAdapter{listener},
+		conntrack: conntrack.New(conntrack.Config{}),
+		metrics:   metrics.New(),
 	}
 
 	fakeDNSAddr, err := net.ResolveUDPAddr("udp", fakeDNS)
@@ -62,28 +93,75 @@ func NewIntraDevice(fakeDNS, serverURL, fallbackAddrs string, protector SocketPr
 
 	d.sni = sni.MakeTCPReporter(dohServer)
 
-	d.sd, err = doh.MakeDoHStreamDialer(fakeDNSAddr.AddrPort(), dohServer, d.protector, d.listener, d.sni)
+	d.sd, err = doh.MakeDoHStreamDialer(fakeDNSAddr.AddrPort(), dohServer, d.protector, d.listener, d.sni, d.conntrack, d.metrics, transportConfig)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create stream dialer: %w", err)
 	}
 
-	d.pp, err = doh.MakeDoHPacketProxy(fakeDNSAddr.AddrPort(), dohServer, d.protector, d.listener)
+	d.pp, err = doh.MakeDoHPacketProxy(fakeDNSAddr.AddrPort(), dohServer, d.protector, d.listener, d.conntrack)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create packet proxy: %w", err)
 	}
 
-	if d.t2s, err = lwip2transport.ConfigureDevice(d.sd, d.pp); err != nil {
-		return nil, fmt.Errorf("failed to configure lwIP stack: %w", err)
+	switch backend {
+	case BackendGoNAT:
+		d.t2s, err = gonat.ConfigureDevice(d.sd, d.pp)
+	default:
+		d.t2s, err = lwip2transport.ConfigureDevice(d.sd, d.pp)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure tun device: %w", err)
 	}
 
+	d.socks = socks5.NewServer(d.sd, d.pp, fakeDNSAddr.AddrPort(), d.protector)
+
 	log.Println("[info] Intra device initialized")
 	return
 }
 
 func (d *IntraDevice) Close() error {
+	d.socks.Stop()
+	d.conntrack.Close()
 	return d.t2s.Close()
 }
 
+// StartSOCKS5 starts a SOCKS5 server (RFC 1928) on listenAddr, giving
+// clients that can't use Android's VpnService (e.g. a local test harness)
+// the same DNS interception and port-443 splitting as traffic routed
+// through the tun device. Calling it while already running is an error.
+func (d *IntraDevice) StartSOCKS5(listenAddr string) error {
+	return d.socks.Start(listenAddr)
+}
+
+// StopSOCKS5 stops the SOCKS5 server started by StartSOCKS5, if running.
+func (d *IntraDevice) StopSOCKS5() error {
+	return d.socks.Stop()
+}
+
+// SetSOCKS5Credentials requires SOCKS5 clients to authenticate with the
+// given username/password (RFC 1929) instead of the default no-auth
+// method. Passing empty strings for both reverts to no-auth.
+func (d *IntraDevice) SetSOCKS5Credentials(username, password string) {
+	if username == "" && password == "" {
+		d.socks.SetCredentials(nil)
+		return
+	}
+	d.socks.SetCredentials(&socks5.Credentials{Username: username, Password: password})
+}
+
+// SetRouter installs r, letting its Clash-style rules override which DoH
+// server answers a query and which transport config dials port 443,
+// instead of every connection using the device's own configured DoH
+// server and transport config. Pass nil to remove routing and revert to
+// that default behavior.
+func (d *IntraDevice) SetRouter(r *Router) error {
+	var router doh.Router
+	if r != nil {
+		router = r.r
+	}
+	return errors.Join(d.sd.SetRouter(router), d.pp.SetRouter(router))
+}
+
 func (d *IntraDevice) UpdateDoHServer(serverURL, fallbackAddrs string) error {
 	dohServer, err := doh.MakeTransport(serverURL, fallbackAddrs, d.protector, d.listener)
 	if err != nil {
@@ -0,0 +1,145 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/conntrack"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/doh"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/sni"
+	intraLegacy "github.com/Jigsaw-Code/outline-go-tun2socks/intra"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// DoHServer is a standalone DoH transport that can be registered with a
+// Router as an outbound, independent of any IntraDevice's own DoH server.
+type DoHServer struct {
+	tspt doh.DoHTransport
+}
+
+// NewDoHServer creates a DoHServer for serverURL, trying fallbackAddrs (a
+// comma-separated list of IPs or hostnames) if serverURL's hostname can't
+// be resolved. See SocketProtector for what protector is for.
+func NewDoHServer(serverURL, fallbackAddrs string, protector SocketProtector) (*DoHServer, error) {
+	tspt, err := doh.MakeTransport(serverURL, fallbackAddrs, protector, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DoH transport: %w", err)
+	}
+	return &DoHServer{tspt: tspt}, nil
+}
+
+// NewDoHServerPreferringH3 is NewDoHServer's H3Transport opt-in: it builds a
+// DoH-over-HTTP/3 transport pooled ahead of the ordinary HTTP/2 transport
+// NewDoHServer builds, falling back to the latter if H3 can't be dialed or
+// its circuit breaker trips (see doh.PrimaryFallback). listener,
+// sniReporter, and ct are used exactly as in doh.MakeH3Transport, to exempt
+// the H3 QUIC socket from the VPN and report its stats/SNI/conntrack flow
+// the same way a TCP DoH connection would.
+func NewDoHServerPreferringH3(serverURL, fallbackAddrs string, protector SocketProtector, listener intraLegacy.TCPListener, sniReporter sni.TCPSNIReporter, ct *conntrack.Table) (*DoHServer, error) {
+	h2, err := doh.MakeTransport(serverURL, fallbackAddrs, protector, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DoH transport: %w", err)
+	}
+	h3, err := doh.MakeH3Transport(serverURL, protector, listener, sniReporter, ct)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DoH3 transport: %w", err)
+	}
+	pool, err := doh.NewTransportPool([]doh.DoHTransport{h3, h2}, doh.PrimaryFallback)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create DoH transport pool: %w", err)
+	}
+	return &DoHServer{tspt: pool}, nil
+}
+
+// DoHProbeResult is the structured outcome of a DoHServer.ProbeWith call,
+// exposing enough to distinguish different failure modes (a censored
+// NXDOMAIN, an HTTP error from the server, a malformed or truncated
+// response) instead of a single pass/fail boolean.
+type DoHProbeResult struct {
+	// Latency is how long the query took, from just before it was sent to
+	// just after the response arrived (or the attempt failed).
+	Latency time.Duration
+	// HTTPStatus is the response's HTTP status code, or 0 if it couldn't be
+	// determined - s.tspt.Query doesn't expose one directly, so this is only
+	// populated when the underlying error implements httpStatusError, as
+	// H3Transport's does (a DoHServer built by NewDoHServer instead of
+	// NewDoHServerPreferringH3 never populates this field, since the legacy
+	// HTTP/2 transport it wraps doesn't report a typed status error).
+	HTTPStatus int
+	// RCode is the response message's DNS response code (e.g.
+	// dnsmessage.RCodeSuccess, RCodeNameError for NXDOMAIN). It's only
+	// meaningful when Response is non-empty.
+	RCode dnsmessage.RCode
+	// AnswerCount is the number of resource records in the response's
+	// answer section.
+	AnswerCount int
+	// Response is the raw DNS wire-format response, or nil if the query
+	// failed before one arrived.
+	Response []byte
+}
+
+// httpStatusError is implemented by a Query error that knows the HTTP
+// status code the server responded with.
+type httpStatusError interface {
+	StatusCode() int
+}
+
+// Probe checks that s can handle DNS-over-HTTP (DoH) requests, the way
+// ProbeDoHServer does, by querying it for youtube.com's A record.
+func (s *DoHServer) Probe() error {
+	_, err := s.ProbeWith(context.Background(), "youtube.com", uint16(dnsmessage.TypeA))
+	return err
+}
+
+// ProbeWith queries s for qname/qtype (e.g. dnsmessage.TypeA) and returns a
+// DoHProbeResult describing what happened, even on failure - err is only
+// non-nil when the query couldn't be attempted, the response is empty or
+// couldn't be parsed at all, or its ID doesn't match the query's, not
+// merely because it reports an unsuccessful RCode.
+func (s *DoHServer) ProbeWith(ctx context.Context, qname string, qtype uint16) (*DoHProbeResult, error) {
+	query, id, err := doh.BuildQuery(qname, dnsmessage.Type(qtype))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build probe query: %w", err)
+	}
+
+	start := time.Now()
+	resp, queryErr := s.tspt.Query(query)
+	result := &DoHProbeResult{Latency: time.Since(start)}
+	if statusErr := new(httpStatusError); errors.As(queryErr, statusErr) {
+		result.HTTPStatus = (*statusErr).StatusCode()
+	}
+	if queryErr != nil {
+		return result, fmt.Errorf("DoH query failed: %w", queryErr)
+	}
+	if len(resp) == 0 {
+		return result, errors.New("DoH response is empty")
+	}
+	result.Response = resp
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return result, fmt.Errorf("failed to parse DoH response: %w", err)
+	}
+	if msg.ID != id {
+		return result, fmt.Errorf("DoH response ID %d doesn't match query ID %d", msg.ID, id)
+	}
+	result.RCode = msg.RCode
+	result.AnswerCount = len(msg.Answers)
+	return result, nil
+}
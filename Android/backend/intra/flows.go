@@ -0,0 +1,99 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/conntrack"
+)
+
+// FlowStats is a point-in-time snapshot of one live network flow, as
+// tracked by Intra's connection table. See [IntraDevice.Flows] and
+// [IntraDevice.FlowsSince].
+type FlowStats interface {
+	GetProtocol() string    // "tcp" or "udp"
+	GetDestination() string // host:port this flow is talking to
+	GetServerPort() int16   // The server port.  All values except 80, 443, and 0 are set to -1.
+	GetStartTime() int64    // Unix seconds
+	GetLastActivity() int64 // Unix seconds
+	GetUploadBytes() int64
+	GetDownloadBytes() int64
+	GetUploadPackets() int64
+	GetDownloadPackets() int64
+	GetAppProtocol() string   // Sniffed L7 protocol, e.g. "tls", "http", "quic-initial", "unknown".
+	GetTLSServerName() string // TLS SNI, if GetAppProtocol() == "tls" and it was present.
+	GetTLSALPN() string       // TLS ALPN, if GetAppProtocol() == "tls" and it was present.
+	GetRetry() TCPRetryStats  // Retry is non-nil if retry was possible. Only set for TCP flows.
+	GetGeneration() uint64    // The table generation this snapshot was last updated at.
+}
+
+type flowStatsAdapter struct {
+	conntrack.FlowStats
+}
+
+func (s flowStatsAdapter) GetProtocol() string       { return s.Tuple.Proto }
+func (s flowStatsAdapter) GetDestination() string    { return s.Tuple.Dst.String() }
+func (s flowStatsAdapter) GetServerPort() int16      { return s.ServerPort }
+func (s flowStatsAdapter) GetStartTime() int64       { return s.StartTime.Unix() }
+func (s flowStatsAdapter) GetLastActivity() int64    { return s.LastActivity.Unix() }
+func (s flowStatsAdapter) GetUploadBytes() int64     { return s.UploadBytes }
+func (s flowStatsAdapter) GetDownloadBytes() int64   { return s.DownloadBytes }
+func (s flowStatsAdapter) GetUploadPackets() int64   { return s.UploadPackets }
+func (s flowStatsAdapter) GetDownloadPackets() int64 { return s.DownloadPackets }
+func (s flowStatsAdapter) GetAppProtocol() string    { return s.Protocol }
+func (s flowStatsAdapter) GetTLSServerName() string  { return s.TLSServerName }
+func (s flowStatsAdapter) GetTLSALPN() string        { return s.TLSALPN }
+func (s flowStatsAdapter) GetGeneration() uint64     { return s.Generation }
+
+func (s flowStatsAdapter) GetRetry() TCPRetryStats {
+	if s.Retry == nil {
+		return nil
+	}
+	return flowRetryStatsAdapter{s.Retry}
+}
+
+type flowRetryStatsAdapter struct {
+	*conntrack.RetryStats
+}
+
+func (s flowRetryStatsAdapter) GetSNI() string   { return s.SNI }
+func (s flowRetryStatsAdapter) GetBytes() int32  { return s.Bytes }
+func (s flowRetryStatsAdapter) GetChunks() int16 { return s.Chunks }
+func (s flowRetryStatsAdapter) GetSplit() int16  { return s.Split }
+func (s flowRetryStatsAdapter) GetTimeout() bool { return s.Timeout }
+
+func toFlowStats(flows []conntrack.FlowStats) []FlowStats {
+	out := make([]FlowStats, len(flows))
+	for i, f := range flows {
+		out[i] = flowStatsAdapter{f}
+	}
+	return out
+}
+
+// Flows returns a snapshot of every flow currently tracked by the device's
+// connection table. A flow leaves the table when it is closed or has been
+// idle past its timeout, so closed flows are not included.
+func (d *IntraDevice) Flows() []FlowStats {
+	return toFlowStats(d.conntrack.Flows())
+}
+
+// FlowsSince returns every tracked flow that has changed since gen
+// (typically the value previously returned by Flows or FlowsSince), along
+// with the table's current generation to pass on the next call. This lets
+// the UI poll for live traffic stats incrementally instead of re-fetching
+// the whole table. Passing 0 returns every flow.
+func (d *IntraDevice) FlowsSince(gen uint64) ([]FlowStats, uint64) {
+	flows, newGen := d.conntrack.FlowsSince(gen)
+	return toFlowStats(flows), newGen
+}
@@ -0,0 +1,290 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package classify implements a small, bounded-effort L7 protocol sniffer for
+// the TCP and UDP data paths. It is intentionally shallow: it looks at the
+// first few reads/writes of a flow and gives up as soon as it either
+// recognizes a protocol or runs out of budget, so it can never stall
+// forwarding.
+package classify
+
+import (
+	"encoding/binary"
+	"regexp"
+	"sync"
+)
+
+// Result is what a [Classifier] reports once it has made up its mind (or
+// given up) about a flow.
+type Result struct {
+	Protocol      string // e.g. "tls", "http", "ssh", "quic-initial", "unknown"
+	TLSServerName string // SNI, if Protocol == "tls" and it was present
+	TLSALPN       string // first ALPN protocol offered, if present
+}
+
+// Unknown is the result returned once a [Classifier] has
+// exhausted its buffer budget without recognizing anything.
+var Unknown = Result{Protocol: "unknown"}
+
+// DefaultBudget is the maximum number of bytes per direction a [Classifier]
+// will buffer before giving up.
+const DefaultBudget = 4096
+
+// Classifier incrementally buffers the start of one direction of a flow and
+// tries a fixed sequence of matchers against it. It is not safe for
+// concurrent use; callers should keep one instance per direction.
+type Classifier struct {
+	budget int
+	buf    []byte
+	done   bool
+	result Result
+}
+
+// New returns a [Classifier] with the given per-direction byte budget. A
+// budget <= 0 uses [DefaultBudget].
+func New(budget int) *Classifier {
+	if budget <= 0 {
+		budget = DefaultBudget
+	}
+	return &Classifier{budget: budget}
+}
+
+// Feed appends b to the classifier's buffer and attempts classification. It
+// returns (result, true) once a verdict has been reached, either because a
+// matcher recognized the buffer or because the byte budget was exhausted;
+// after that, subsequent calls are no-ops that keep returning the same
+// result. It returns (Result{}, false) while more bytes are still wanted.
+func (c *Classifier) Feed(b []byte) (Result, bool) {
+	if c.done {
+		return c.lastResult(), true
+	}
+	c.buf = append(c.buf, b...)
+
+	for _, m := range matchers {
+		if r, ok := m(c.buf); ok {
+			c.done = true
+			c.result = r
+			return r, true
+		}
+	}
+
+	if len(c.buf) >= c.budget {
+		c.done = true
+		c.result = Unknown
+		return Unknown, true
+	}
+	return Result{}, false
+}
+
+func (c *Classifier) lastResult() Result {
+	return c.result
+}
+
+// matcher looks at the bytes buffered so far and either recognizes a
+// protocol (returning ok=true) or asks for more data (ok=false, which may
+// still mean "never going to match" once the caller's budget runs out).
+type matcher func(buf []byte) (Result, bool)
+
+var matchers = []matcher{matchTLSClientHello, matchHTTP, matchSSH}
+
+// matchTLSClientHello recognizes a TLS record carrying a ClientHello
+// handshake message, and extracts the SNI (extension 0) and ALPN
+// (extension 16) values when present.
+func matchTLSClientHello(buf []byte) (Result, bool) {
+	const (
+		recordHeaderLen = 5
+		handshakeType   = 0x16
+		clientHello     = 0x01
+	)
+	if len(buf) < recordHeaderLen+4 {
+		return Result{}, false
+	}
+	if buf[0] != handshakeType || buf[1] != 0x03 {
+		return Result{}, false
+	}
+	recordLen := int(binary.BigEndian.Uint16(buf[3:5]))
+	if len(buf) < recordHeaderLen+recordLen {
+		// Wait for the rest of the record, up to the caller's budget.
+		return Result{}, false
+	}
+	body := buf[recordHeaderLen : recordHeaderLen+recordLen]
+	if len(body) < 4 || body[0] != clientHello {
+		return Result{}, false
+	}
+
+	sni, alpn := parseClientHelloExtensions(body)
+	return Result{Protocol: "tls", TLSServerName: sni, TLSALPN: alpn}, true
+}
+
+// parseClientHelloExtensions walks a ClientHello handshake body (starting at
+// the handshake type byte) looking for the SNI and ALPN extensions. It
+// returns empty strings for either that isn't present or can't be parsed;
+// malformed input never aborts classification, it just yields less detail.
+func parseClientHelloExtensions(body []byte) (sni, alpn string) {
+	defer func() { recover() }() // malformed/truncated hellos must not panic the caller
+
+	p := body[4:] // skip handshake type(1) + length(3)
+	p = p[2:]     // client_version
+	p = p[32:]    // random
+
+	sessionIDLen := int(p[0])
+	p = p[1+sessionIDLen:]
+
+	cipherSuitesLen := int(binary.BigEndian.Uint16(p))
+	p = p[2+cipherSuitesLen:]
+
+	compressionMethodsLen := int(p[0])
+	p = p[1+compressionMethodsLen:]
+
+	if len(p) < 2 {
+		return
+	}
+	extensionsLen := int(binary.BigEndian.Uint16(p))
+	p = p[2:]
+	if len(p) < extensionsLen {
+		return
+	}
+	ext := p[:extensionsLen]
+
+	for len(ext) >= 4 {
+		extType := binary.BigEndian.Uint16(ext)
+		extLen := int(binary.BigEndian.Uint16(ext[2:4]))
+		ext = ext[4:]
+		if len(ext) < extLen {
+			return
+		}
+		data := ext[:extLen]
+		switch extType {
+		case 0: // server_name
+			sni = parseSNIExtension(data)
+		case 16: // application_layer_protocol_negotiation
+			alpn = parseALPNExtension(data)
+		}
+		ext = ext[extLen:]
+	}
+	return
+}
+
+func parseSNIExtension(data []byte) string {
+	if len(data) < 5 {
+		return ""
+	}
+	nameLen := int(binary.BigEndian.Uint16(data[3:5]))
+	if len(data) < 5+nameLen {
+		return ""
+	}
+	return string(data[5 : 5+nameLen])
+}
+
+func parseALPNExtension(data []byte) string {
+	if len(data) < 3 {
+		return ""
+	}
+	protoLen := int(data[2])
+	if len(data) < 3+protoLen {
+		return ""
+	}
+	return string(data[3 : 3+protoLen])
+}
+
+var httpRequestLine = regexp.MustCompile(`^(GET|POST|PUT|HEAD|DELETE|OPTIONS|PATCH|CONNECT) \S+ HTTP/\d\.\d\r\n`)
+
+func matchHTTP(buf []byte) (Result, bool) {
+	if httpRequestLine.Match(buf) {
+		return Result{Protocol: "http"}, true
+	}
+	// Give up as soon as we have enough bytes to have seen a request line,
+	// or a byte that couldn't possibly start one.
+	if len(buf) >= 3 && !couldBeHTTPPrefix(buf) {
+		return Result{}, false
+	}
+	return Result{}, false
+}
+
+func couldBeHTTPPrefix(buf []byte) bool {
+	for _, m := range []string{"GET", "POST", "PUT", "HEAD", "DELETE", "OPTIONS", "PATCH", "CONNECT"} {
+		n := len(buf)
+		if n > len(m) {
+			n = len(m)
+		}
+		if string(buf[:n]) == m[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+var sshBanner = []byte("SSH-2.0")
+
+func matchSSH(buf []byte) (Result, bool) {
+	if len(buf) < len(sshBanner) {
+		return Result{}, false
+	}
+	n := len(sshBanner)
+	if string(buf[:n]) == string(sshBanner) {
+		return Result{Protocol: "ssh"}, true
+	}
+	return Result{}, false
+}
+
+// MatchQUICInitial recognizes a QUIC Initial packet's long-header form
+// (RFC 9000 §17.2.2): fixed bit set, long-header bit set, and a version
+// field that isn't the reserved "version negotiation" value 0.
+func MatchQUICInitial(buf []byte) bool {
+	const (
+		longHeaderMask = 0x80
+		fixedBitMask   = 0x40
+		packetTypeMask = 0x30 // long packet type bits; Initial is 0b00
+	)
+	if len(buf) < 5 {
+		return false
+	}
+	if buf[0]&longHeaderMask == 0 || buf[0]&fixedBitMask == 0 {
+		return false
+	}
+	if buf[0]&packetTypeMask != 0 {
+		return false
+	}
+	version := binary.BigEndian.Uint32(buf[1:5])
+	return version != 0
+}
+
+// registry lets a TCP classification result, which is computed deep inside
+// the DoH stream dialer, be looked up later by the outer event-listener
+// adapter when it builds the public TCPSocketStats for a closed flow. Flows
+// are registered and removed once, so this never grows unbounded.
+var registry sync.Map // map[any]Result
+
+// Record stores r so that a later [Lookup] with the same key retrieves it.
+// key is typically the flow's *intra.TCPSocketSummary pointer, used purely
+// for its identity.
+func Record(key any, r Result) {
+	registry.Store(key, r)
+}
+
+// Lookup retrieves the classification previously stored for key, if any.
+func Lookup(key any) (Result, bool) {
+	r, ok := registry.Load(key)
+	if !ok {
+		return Unknown, false
+	}
+	return r.(Result), true
+}
+
+// Forget removes the classification stored for key. Callers should call
+// this once the flow has been reported to its listener, so the registry
+// does not retain state for closed flows.
+func Forget(key any) {
+	registry.Delete(key)
+}
@@ -0,0 +1,111 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package config turns an Outline-SDK style config string - a "|"-separated
+// list of "scheme://..." segments - into a chain of wrapped
+// transport.StreamDialers. It's modeled on outline-sdk's
+// ConfigParser.RegisterStreamDialerWrapper pattern: a wrapper only needs to
+// know how to wrap the dialer it's handed, and StreamDialerParser is the
+// only thing that knows how to compose them in order. That keeps adding a
+// new circumvention primitive (e.g. a TLS record fragmenter) to a single
+// RegisterStreamDialerWrapper call, instead of a change to every call site
+// that currently hardcodes a dial strategy.
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// NewStreamDialerFunc builds the transport.StreamDialer for one "scheme://..."
+// config segment, wrapping base - the dialer produced by the previous
+// segment, or the chain's root dialer for the first one.
+type NewStreamDialerFunc func(ctx context.Context, config *url.URL, base transport.StreamDialer) (transport.StreamDialer, error)
+
+// StreamDialerParser composes registered NewStreamDialerFuncs into a single
+// transport.StreamDialer, according to a config string.
+type StreamDialerParser struct {
+	root     transport.StreamDialer
+	wrappers map[string]NewStreamDialerFunc
+}
+
+// NewStreamDialerParser creates a parser whose chain starts at root, with no
+// wrappers registered. root is typically a *transport.TCPStreamDialer built
+// from whatever net.Dialer the caller needs (e.g. a protected one).
+func NewStreamDialerParser(root transport.StreamDialer) *StreamDialerParser {
+	return &StreamDialerParser{
+		root:     root,
+		wrappers: make(map[string]NewStreamDialerFunc),
+	}
+}
+
+// RegisterStreamDialerWrapper associates scheme with wrapper, so that a
+// "scheme://..." config segment invokes it. Registering the same scheme
+// twice replaces the earlier wrapper.
+func (p *StreamDialerParser) RegisterStreamDialerWrapper(scheme string, wrapper NewStreamDialerFunc) {
+	p.wrappers[scheme] = wrapper
+}
+
+// Parse builds a transport.StreamDialer by applying every segment of
+// configStr, in order, to the parser's root dialer. Segments are separated
+// by "|"; a bare segment with no "://" (e.g. "split") is treated as
+// "scheme://", i.e. a wrapper invoked with no query parameters. An empty
+// configStr returns the root dialer unchanged.
+func (p *StreamDialerParser) Parse(ctx context.Context, configStr string) (transport.StreamDialer, error) {
+	dialer := p.root
+	for _, segment := range strings.Split(configStr, "|") {
+		segment = strings.TrimSpace(segment)
+		if segment == "" {
+			continue
+		}
+		if !strings.Contains(segment, "://") {
+			segment += "://"
+		}
+		u, err := url.Parse(segment)
+		if err != nil {
+			return nil, fmt.Errorf("invalid config segment %q: %w", segment, err)
+		}
+		wrapper, ok := p.wrappers[u.Scheme]
+		if !ok {
+			return nil, fmt.Errorf("unknown stream dialer wrapper %q", u.Scheme)
+		}
+		if dialer, err = wrapper(ctx, u, dialer); err != nil {
+			return nil, fmt.Errorf("failed to apply %q wrapper: %w", u.Scheme, err)
+		}
+	}
+	return dialer, nil
+}
+
+// NewDefaultStreamDialerParser returns a StreamDialerParser rooted at root
+// with the split, splitretry, override, and doh wrappers registered.
+func NewDefaultStreamDialerParser(root transport.StreamDialer) *StreamDialerParser {
+	p := NewStreamDialerParser(root)
+	p.RegisterStreamDialerWrapper("split", newSplitDialer)
+	p.RegisterStreamDialerWrapper("splitretry", newSplitRetryDialer)
+	p.RegisterStreamDialerWrapper("override", newOverrideDialer)
+	p.RegisterStreamDialerWrapper("doh", newDoHDialer)
+	return p
+}
+
+// ParseConfig parses configStr with a default parser rooted at a plain,
+// unprotected *transport.TCPStreamDialer. Callers that need a protected or
+// otherwise customized root dialer (e.g. dohSplitStreamDialer) should use
+// NewDefaultStreamDialerParser directly instead.
+func ParseConfig(configStr string) (transport.StreamDialer, error) {
+	return NewDefaultStreamDialerParser(&transport.TCPStreamDialer{}).Parse(context.Background(), configStr)
+}
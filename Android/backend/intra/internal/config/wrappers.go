@@ -0,0 +1,198 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	legacySplit "github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// parseFallbackAddrs splits a comma-separated "ips=" query value into its
+// individual addresses. FieldsFunc (rather than Split) handles an empty
+// string by returning no addresses instead of one empty one.
+func parseFallbackAddrs(ipList string) []string {
+	return strings.FieldsFunc(ipList, func(c rune) bool { return c == ',' })
+}
+
+// tcpDialerOf returns the *net.Dialer backing base. The split and
+// splitretry wrappers are implemented against the legacy split package's
+// net.Dialer-based API rather than the generic transport.StreamDialer
+// interface, so they must be the first wrapper applied to a plain TCP root -
+// there's no way to fragment a ClientHello once some other wrapper has
+// already taken over Dial.
+func tcpDialerOf(base transport.StreamDialer) (*net.Dialer, error) {
+	tcpsd, ok := base.(*transport.TCPStreamDialer)
+	if !ok {
+		return nil, fmt.Errorf("split-family wrappers require a *transport.TCPStreamDialer base, got %T", base)
+	}
+	return &tcpsd.Dialer, nil
+}
+
+// splitStreamConn records the legacySplit.RetryStats alongside the
+// transport.StreamConn a split/splitretry dial produced, so a caller that
+// wants per-connection retry telemetry can recover it with RetryStatsOf
+// without the generic transport.StreamDialer interface needing a stats
+// out-param.
+type splitStreamConn struct {
+	transport.StreamConn
+	stats *legacySplit.RetryStats
+}
+
+// RetryStatsOf returns the split.RetryStats recorded by the "split" or
+// "splitretry" wrapper that produced conn, or nil if conn didn't come from
+// either of them.
+func RetryStatsOf(conn transport.StreamConn) *legacySplit.RetryStats {
+	if c, ok := conn.(*splitStreamConn); ok {
+		return c.stats
+	}
+	return nil
+}
+
+// splitStreamDialer adapts the legacy split package's net.Dialer-based
+// DialWithSplit and DialWithSplitRetry to the transport.StreamDialer
+// interface, so they can take their place in a config chain.
+type splitStreamDialer struct {
+	dialer *net.Dialer
+	retry  bool
+}
+
+var _ transport.StreamDialer = (*splitStreamDialer)(nil)
+
+// Dial implements transport.StreamDialer.Dial.
+func (d *splitStreamDialer) Dial(ctx context.Context, raddr string) (transport.StreamConn, error) {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", raddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid split target %q: %w", raddr, err)
+	}
+	stats := &legacySplit.RetryStats{}
+	var conn transport.StreamConn
+	if d.retry {
+		conn, err = legacySplit.DialWithSplitRetry(d.dialer, tcpAddr, stats)
+	} else {
+		conn, err = legacySplit.DialWithSplit(d.dialer, tcpAddr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &splitStreamConn{StreamConn: conn, stats: stats}, nil
+}
+
+// newSplitDialer implements the "split" wrapper: it unconditionally splits
+// the first outgoing TCP segment, the way dohSplitStreamDialer.dial used to
+// when alwaysSplitHTTPS was set.
+func newSplitDialer(_ context.Context, _ *url.URL, base transport.StreamDialer) (transport.StreamDialer, error) {
+	dialer, err := tcpDialerOf(base)
+	if err != nil {
+		return nil, err
+	}
+	return &splitStreamDialer{dialer: dialer}, nil
+}
+
+// newSplitRetryDialer implements the "splitretry" wrapper: it dials
+// normally, and only splits the first segment on retry, the way
+// dohSplitStreamDialer.dial used to by default.
+func newSplitRetryDialer(_ context.Context, _ *url.URL, base transport.StreamDialer) (transport.StreamDialer, error) {
+	dialer, err := tcpDialerOf(base)
+	if err != nil {
+		return nil, err
+	}
+	return &splitStreamDialer{dialer: dialer, retry: true}, nil
+}
+
+// overrideStreamDialer replaces the destination address Dial is called
+// with, so a chain can pin a hostname to a known-good address (e.g. to
+// route around a poisoned resolver) without its caller knowing.
+type overrideStreamDialer struct {
+	base transport.StreamDialer
+	host string
+	port string
+}
+
+var _ transport.StreamDialer = (*overrideStreamDialer)(nil)
+
+// Dial implements transport.StreamDialer.Dial.
+func (d *overrideStreamDialer) Dial(ctx context.Context, raddr string) (transport.StreamConn, error) {
+	port := d.port
+	if port == "" {
+		if _, origPort, err := net.SplitHostPort(raddr); err == nil {
+			port = origPort
+		}
+	}
+	return d.base.Dial(ctx, net.JoinHostPort(d.host, port))
+}
+
+// newOverrideDialer implements the "override" wrapper:
+// override://?host=1.2.3.4&port=443 pins every Dial through base to host,
+// keeping the caller's original port unless the config also specifies one.
+func newOverrideDialer(_ context.Context, config *url.URL, base transport.StreamDialer) (transport.StreamDialer, error) {
+	host := config.Query().Get("host")
+	if host == "" {
+		return nil, errors.New("override requires a host query parameter")
+	}
+	return &overrideStreamDialer{base: base, host: host, port: config.Query().Get("port")}, nil
+}
+
+// newDoHDialer implements the "doh" wrapper:
+// doh://dns.example/dns-query?ips=1.1.1.1,1.0.0.1 pins every Dial through
+// base to the DoH resolver's own host (falling back to each address in ips
+// in turn if host can't be dialed), so an earlier split stage in the
+// chain fragments the connection Intra makes to its *resolver*, not just
+// the connections it proxies on the resolver's behalf.
+func newDoHDialer(_ context.Context, config *url.URL, base transport.StreamDialer) (transport.StreamDialer, error) {
+	host := config.Hostname()
+	if host == "" {
+		return nil, fmt.Errorf("invalid doh config %q: missing host", config)
+	}
+	port := config.Port()
+	if port == "" {
+		port = "443"
+	}
+	return &doHPinnedDialer{base: base, host: host, port: port, fallbackIPs: parseFallbackAddrs(config.Query().Get("ips"))}, nil
+}
+
+// doHPinnedDialer is the transport.StreamDialer the "doh" wrapper returns.
+// It tries host first, falling back to each address in fallbackIPs in turn
+// if host can't be dialed - the same fallback behavior doh.MakeTransport
+// already gives the DoH query path, just applied to the chain's underlying
+// TCP connection instead.
+type doHPinnedDialer struct {
+	base        transport.StreamDialer
+	host        string
+	port        string
+	fallbackIPs []string
+}
+
+var _ transport.StreamDialer = (*doHPinnedDialer)(nil)
+
+// Dial implements transport.StreamDialer.Dial.
+func (d *doHPinnedDialer) Dial(ctx context.Context, _ string) (transport.StreamConn, error) {
+	conn, err := d.base.Dial(ctx, net.JoinHostPort(d.host, d.port))
+	if err == nil {
+		return conn, nil
+	}
+	for _, ip := range d.fallbackIPs {
+		if conn, fallbackErr := d.base.Dial(ctx, net.JoinHostPort(ip, d.port)); fallbackErr == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to dial DoH server %s: %w", d.host, err)
+}
@@ -0,0 +1,433 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package conntrack maintains a live table of 5-tuple flows, similar in
+// spirit to the kernel's nf_conntrack: callers register a flow when it is
+// dialed and report byte/packet counts as they happen, and the table
+// evicts flows itself once they go idle for longer than a configurable
+// timeout. This lets the Android UI poll for live traffic stats instead of
+// only learning about a flow once it has already closed.
+package conntrack
+
+import (
+	"container/heap"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Default idle timeouts, chosen to match common conntrack defaults: give a
+// flow that never finished its handshake much less slack than one that did.
+const (
+	DefaultTCPTimeout      = 300 * time.Second
+	DefaultUDPTimeout      = 60 * time.Second
+	DefaultHalfOpenTimeout = 10 * time.Second
+)
+
+// FiveTuple identifies a flow. Intra's lwIP-based data path does not expose
+// the client-side (device-local) port to the DoH dialer/packet proxy, so
+// Src is omitted; Dst and Proto are enough to distinguish concurrent flows
+// to different destinations, which is what the UI needs.
+type FiveTuple struct {
+	Proto string // "tcp" or "udp"
+	Dst   netip.AddrPort
+}
+
+// RetryStats mirrors the shape of split.RetryStats. conntrack is imported by
+// code that must not depend on any particular TCP implementation, so it
+// defines its own copy rather than importing split.
+type RetryStats struct {
+	SNI     string
+	Bytes   int32
+	Chunks  int16
+	Split   int16
+	Timeout bool
+}
+
+// FlowStats is a point-in-time, immutable snapshot of one tracked flow.
+type FlowStats struct {
+	Tuple           FiveTuple
+	StartTime       time.Time
+	LastActivity    time.Time
+	UploadBytes     int64
+	DownloadBytes   int64
+	UploadPackets   int64
+	DownloadPackets int64
+	ServerPort      int16
+	Protocol        string // sniffed L7 protocol, e.g. "tls", "http", "unknown"
+	TLSServerName   string
+	TLSALPN         string
+	Retry           *RetryStats
+	Generation      uint64
+}
+
+// Config controls the idle timeouts used by a [Table]. A zero Config uses
+// the Default* constants.
+type Config struct {
+	TCPTimeout      time.Duration
+	UDPTimeout      time.Duration
+	HalfOpenTimeout time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.TCPTimeout <= 0 {
+		c.TCPTimeout = DefaultTCPTimeout
+	}
+	if c.UDPTimeout <= 0 {
+		c.UDPTimeout = DefaultUDPTimeout
+	}
+	if c.HalfOpenTimeout <= 0 {
+		c.HalfOpenTimeout = DefaultHalfOpenTimeout
+	}
+	return c
+}
+
+// entry is the live, mutable record behind a flow. Counters use their own
+// lock rather than atomics because they are always updated together with
+// the eviction deadline, which does need a lock (to keep the heap
+// consistent).
+type entry struct {
+	tuple      FiveTuple
+	startTime  time.Time
+	serverPort int16
+
+	mu              sync.Mutex
+	lastActivity    time.Time
+	uploadBytes     int64
+	downloadBytes   int64
+	uploadPackets   int64
+	downloadPackets int64
+	established     bool
+	protocol        string
+	tlsServerName   string
+	tlsALPN         string
+	retry           *RetryStats
+	generation      uint64
+
+	deadline time.Time // owned by Table.mu, not entry.mu
+	heapIdx  int
+}
+
+func (e *entry) snapshot(tuple FiveTuple) FlowStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return FlowStats{
+		Tuple:           tuple,
+		StartTime:       e.startTime,
+		LastActivity:    e.lastActivity,
+		UploadBytes:     e.uploadBytes,
+		DownloadBytes:   e.downloadBytes,
+		UploadPackets:   e.uploadPackets,
+		DownloadPackets: e.downloadPackets,
+		ServerPort:      e.serverPort,
+		Protocol:        e.protocol,
+		TLSServerName:   e.tlsServerName,
+		TLSALPN:         e.tlsALPN,
+		Retry:           e.retry,
+		Generation:      e.generation,
+	}
+}
+
+// Table is a live flow table with timeout-based eviction. The zero value is
+// not usable; use [New].
+type Table struct {
+	cfg Config
+
+	mu    sync.Mutex
+	flows map[*entry]struct{}
+	heap  evictionHeap
+
+	generation uint64
+	wake       chan struct{}
+	closeOnce  sync.Once
+	done       chan struct{}
+}
+
+// New creates a Table and starts its background eviction goroutine. Callers
+// must call Close when the table is no longer needed, to stop that
+// goroutine.
+func New(cfg Config) *Table {
+	t := &Table{
+		cfg:   cfg.withDefaults(),
+		flows: make(map[*entry]struct{}),
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	go t.evictLoop()
+	return t
+}
+
+// Close stops the table's eviction goroutine. It does not touch any flows
+// still tracked; callers that want a clean table should Remove them first.
+func (t *Table) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	return nil
+}
+
+// Handle is a caller's reference to one tracked flow, returned by
+// [Table.Start]. Its methods are safe for concurrent use.
+type Handle struct {
+	table *Table
+	entry *entry
+}
+
+// Start begins tracking a new flow and returns a [Handle] for reporting
+// activity on it. The flow starts in the half-open state, with
+// Config.HalfOpenTimeout to either see Touch (traffic) or be evicted;
+// SetEstablished extends it to the full per-protocol timeout.
+func (t *Table) Start(tuple FiveTuple, serverPort int16) Handle {
+	now := time.Now()
+	e := &entry{
+		tuple:        tuple,
+		startTime:    now,
+		serverPort:   serverPort,
+		lastActivity: now,
+		protocol:     "unknown",
+		heapIdx:      -1,
+	}
+
+	t.mu.Lock()
+	t.generation++
+	e.generation = t.generation
+	e.deadline = now.Add(t.cfg.HalfOpenTimeout)
+	t.flows[e] = struct{}{}
+	heap.Push(&t.heap, e)
+	t.mu.Unlock()
+	t.notify()
+
+	return Handle{table: t, entry: e}
+}
+
+// Touch records upload or download activity and refreshes the flow's
+// eviction deadline.
+func (h Handle) Touch(upload bool, bytes int) {
+	if h.entry == nil {
+		return
+	}
+	e := h.entry
+	e.mu.Lock()
+	e.lastActivity = time.Now()
+	if upload {
+		e.uploadBytes += int64(bytes)
+		e.uploadPackets++
+	} else {
+		e.downloadBytes += int64(bytes)
+		e.downloadPackets++
+	}
+	e.mu.Unlock()
+
+	h.table.bump(e)
+}
+
+// SetEstablished extends the flow's deadline from the half-open timeout to
+// the full per-protocol timeout. Callers should call this once a TCP
+// handshake completes, or immediately for UDP (which has no handshake).
+func (h Handle) SetEstablished() {
+	if h.entry == nil {
+		return
+	}
+	e := h.entry
+	e.mu.Lock()
+	e.established = true
+	e.mu.Unlock()
+	h.table.bump(e)
+}
+
+// SetClassification records the sniffed L7 protocol for the flow.
+func (h Handle) SetClassification(protocol, tlsServerName, tlsALPN string) {
+	if h.entry == nil {
+		return
+	}
+	e := h.entry
+	e.mu.Lock()
+	e.protocol = protocol
+	e.tlsServerName = tlsServerName
+	e.tlsALPN = tlsALPN
+	e.mu.Unlock()
+	h.table.bump(e)
+}
+
+// SetRetry records the TCP split-retry state observed for the flow.
+func (h Handle) SetRetry(r RetryStats) {
+	if h.entry == nil {
+		return
+	}
+	e := h.entry
+	e.mu.Lock()
+	e.retry = &r
+	e.mu.Unlock()
+	h.table.bump(e)
+}
+
+// Remove stops tracking the flow immediately, e.g. because the underlying
+// socket was closed. It is idempotent.
+func (h Handle) Remove() {
+	if h.entry == nil {
+		return
+	}
+	h.table.remove(h.entry)
+}
+
+// bump refreshes e's eviction deadline and generation, keeping the heap
+// consistent.
+func (t *Table) bump(e *entry) {
+	t.mu.Lock()
+	if _, tracked := t.flows[e]; !tracked {
+		t.mu.Unlock()
+		return
+	}
+	t.generation++
+	e.mu.Lock()
+	e.generation = t.generation
+	e.mu.Unlock()
+
+	timeout := t.cfg.HalfOpenTimeout
+	e.mu.Lock()
+	established := e.established
+	e.mu.Unlock()
+	if established {
+		if e.tuple.Proto == "udp" {
+			timeout = t.cfg.UDPTimeout
+		} else {
+			timeout = t.cfg.TCPTimeout
+		}
+	}
+	e.deadline = time.Now().Add(timeout)
+	if e.heapIdx >= 0 {
+		heap.Fix(&t.heap, e.heapIdx)
+	}
+	t.mu.Unlock()
+	t.notify()
+}
+
+func (t *Table) remove(e *entry) {
+	t.mu.Lock()
+	if _, tracked := t.flows[e]; tracked {
+		delete(t.flows, e)
+		if e.heapIdx >= 0 {
+			heap.Remove(&t.heap, e.heapIdx)
+		}
+	}
+	t.mu.Unlock()
+}
+
+func (t *Table) notify() {
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+}
+
+// evictLoop runs on its own goroutine for the lifetime of the table,
+// sleeping until either the next deadline or a change to the heap (a new
+// flow, or an existing one being refreshed) wakes it up.
+func (t *Table) evictLoop() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		t.mu.Lock()
+		var wait time.Duration
+		if t.heap.Len() == 0 {
+			wait = time.Hour
+		} else {
+			wait = time.Until(t.heap[0].deadline)
+		}
+		t.mu.Unlock()
+		if wait < 0 {
+			wait = 0
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-t.done:
+			return
+		case <-timer.C:
+		case <-t.wake:
+			continue
+		}
+
+		now := time.Now()
+		t.mu.Lock()
+		for t.heap.Len() > 0 && !t.heap[0].deadline.After(now) {
+			e := heap.Pop(&t.heap).(*entry)
+			delete(t.flows, e)
+		}
+		t.mu.Unlock()
+	}
+}
+
+// Flows returns a snapshot of every currently-tracked flow.
+func (t *Table) Flows() []FlowStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]FlowStats, 0, len(t.flows))
+	for e := range t.flows {
+		stats = append(stats, e.snapshot(e.tuple))
+	}
+	return stats
+}
+
+// FlowsSince returns every tracked flow that has changed since gen
+// (typically the value previously returned by Flows or FlowsSince), along
+// with the table's current generation for the next call. Passing 0 returns
+// every flow, equivalent to Flows.
+func (t *Table) FlowsSince(gen uint64) ([]FlowStats, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]FlowStats, 0, len(t.flows))
+	for e := range t.flows {
+		e.mu.Lock()
+		changed := e.generation > gen
+		e.mu.Unlock()
+		if changed {
+			stats = append(stats, e.snapshot(e.tuple))
+		}
+	}
+	return stats, t.generation
+}
+
+// evictionHeap is a container/heap.Interface ordering entries by their
+// current eviction deadline.
+type evictionHeap []*entry
+
+func (h evictionHeap) Len() int           { return len(h) }
+func (h evictionHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h evictionHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIdx = i
+	h[j].heapIdx = j
+}
+
+func (h *evictionHeap) Push(x any) {
+	e := x.(*entry)
+	e.heapIdx = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *evictionHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.heapIdx = -1
+	*h = old[:n-1]
+	return e
+}
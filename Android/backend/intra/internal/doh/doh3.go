@@ -0,0 +1,261 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/conntrack"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/sni"
+	intraLegacy "github.com/Jigsaw-Code/outline-go-tun2socks/intra"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/protect"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// httpError reports a DoH3 query that reached the server but got back a
+// non-200 HTTP status, as opposed to one that never reached it at all - the
+// distinction DoHServer.ProbeWith's httpStatusError check (dohserver.go)
+// needs, via errors.As, to populate DoHProbeResult.HTTPStatus.
+type httpError struct {
+	status int
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("DoH3 server returned status %d", e.status)
+}
+
+// StatusCode implements dohserver.go's httpStatusError interface.
+func (e *httpError) StatusCode() int {
+	return e.status
+}
+
+// H3Transport is a DoHTransport that speaks DNS-over-HTTPS (RFC 8484) over HTTP/3 in
+// place of DNS-over-HTTPS-over-TCP/TLS. It is a sibling of the transport
+// MakeTransport builds: same public surface (Query, GetURL), so the rest of
+// Intra can select it with no upstream API break.
+type H3Transport struct {
+	url          string
+	roundTripper *http3.RoundTripper
+	session      atomic.Pointer[quicSessionAdapter]
+}
+
+var _ DoHTransport = (*H3Transport)(nil)
+
+// MakeH3Transport builds an H3Transport for serverURL, an "https://" URL
+// whose host Intra can reach over UDP/443. protector, listener, sniReporter,
+// and ct are used exactly as in MakeDoHStreamDialer: to exempt the QUIC
+// socket from the VPN, and to report the resolver connection's stats,
+// handshake SNI, and conntrack flow.
+func MakeH3Transport(serverURL string, protector Protector, listener intraLegacy.TCPListener, sniReporter sni.TCPSNIReporter, ct *conntrack.Table) (*H3Transport, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoH3 server URL: %w", err)
+	}
+
+	t := &H3Transport{url: serverURL}
+	listenConfig := protect.MakeListenConfig(protector)
+	t.roundTripper = &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{ServerName: u.Hostname()},
+		Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+			conn, err := dialProtectedQUIC(ctx, listenConfig, addr, tlsConf, quicConf)
+			if err != nil {
+				return nil, err
+			}
+			session := wrapQUICSession(conn, listener, sniReporter, ct)
+			t.session.Store(session)
+			return session, nil
+		},
+	}
+	return t, nil
+}
+
+// GetURL implements DoHTransport.GetURL.
+func (t *H3Transport) GetURL() string {
+	return t.url
+}
+
+// Query implements DoHTransport.Query: it sends q as a DoH request over the
+// shared QUIC connection to the resolver, letting the RoundTripper dial (or
+// redial) that connection as needed.
+func (t *H3Transport) Query(q []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, t.url, io.NopCloser(bytes.NewReader(q)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build DoH3 request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	req.ContentLength = int64(len(q))
+
+	resp, err := t.roundTripper.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("DoH3 request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &httpError{status: resp.StatusCode}
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DoH3 response: %w", err)
+	}
+
+	if session := t.session.Load(); session != nil {
+		session.recordQuery(len(q), len(body))
+	}
+	return body, nil
+}
+
+// Close releases the underlying QUIC connection, if one has been dialed.
+func (t *H3Transport) Close() error {
+	return t.roundTripper.Close()
+}
+
+// dialProtectedQUIC dials a QUIC connection to addr over a UDP socket
+// obtained from listenConfig, so that Android's VpnService can exempt it
+// from the tunnel the same way protect.MakeDialer's TCP sockets are exempt.
+func dialProtectedQUIC(ctx context.Context, listenConfig *net.ListenConfig, addr string, tlsConf *tls.Config, quicConf *quic.Config) (quic.EarlyConnection, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve DoH3 server address: %w", err)
+	}
+
+	pconn, err := listenConfig.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open protected UDP socket: %w", err)
+	}
+
+	conn, err := quic.DialEarly(ctx, pconn.(net.PacketConn), udpAddr, tlsConf, quicConf)
+	if err != nil {
+		pconn.Close()
+		return nil, fmt.Errorf("failed to establish QUIC connection: %w", err)
+	}
+	return conn, nil
+}
+
+// quicSessionAdapter wraps the QUIC connection an H3Transport reuses across
+// queries. Unlike dohConnAdapter, it has no read/write half-close of its
+// own - a QUIC connection closes as a whole - so both halves of its
+// wg/atomic close bookkeeping are always completed together, by whichever of
+// CloseWithError and the connection-death watcher notices first.
+type quicSessionAdapter struct {
+	quic.EarlyConnection
+
+	wg           *sync.WaitGroup
+	rDone, wDone atomic.Bool
+
+	beginTime time.Time
+	stats     *udpTrafficStats
+
+	listener    intraLegacy.TCPListener
+	sniReporter sni.TCPSNIReporter
+	flow        conntrack.Handle
+}
+
+var _ quic.EarlyConnection = (*quicSessionAdapter)(nil)
+
+func wrapQUICSession(conn quic.EarlyConnection, listener intraLegacy.TCPListener, sniReporter sni.TCPSNIReporter, ct *conntrack.Table) *quicSessionAdapter {
+	log.Println("[debug] establishing new DoH3 QUIC session")
+
+	dest, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+	flow := ct.Start(conntrack.FiveTuple{Proto: "udp", Dst: dest}, makeTCPTrafficStats(dest).ServerPort)
+	flow.SetEstablished()
+
+	session := &quicSessionAdapter{
+		EarlyConnection: conn,
+		wg:              &sync.WaitGroup{},
+		beginTime:       time.Now(),
+		stats:           &udpTrafficStats{sessionStartTime: time.Now()},
+		listener:        listener,
+		sniReporter:     sniReporter,
+		flow:            flow,
+	}
+
+	session.wg.Add(2)
+	go func() {
+		// The connection can also die without an explicit local close, e.g.
+		// on an idle timeout or a network change; either way, Context is
+		// canceled, so this always completes the bookkeeping exactly once.
+		<-conn.Context().Done()
+		session.close(&session.rDone)
+		session.close(&session.wDone)
+	}()
+	go func() {
+		defer func() {
+			log.Printf("[info] DoH3 session [%p] terminated: down = %v, up = %v, span = %v\n",
+				session, session.stats.downloadBytes.Load(), session.stats.uploadBytes.Load(), time.Since(session.beginTime))
+		}()
+		session.wg.Wait()
+		session.report()
+		session.flow.Remove()
+	}()
+
+	return session
+}
+
+// recordQuery attributes one DoH3 query/response pair - a single HTTP/3
+// request stream - to this session's stats, the QUIC equivalent of what
+// dohConnAdapter's Read and Write do per TCP byte.
+func (s *quicSessionAdapter) recordQuery(uploadBytes, downloadBytes int) {
+	s.stats.uploadBytes.Add(int64(uploadBytes))
+	s.stats.downloadBytes.Add(int64(downloadBytes))
+	s.flow.Touch(true, uploadBytes)
+	s.flow.Touch(false, downloadBytes)
+}
+
+// report sends this session's final stats to listener and sniReporter, once
+// the connection has fully closed.
+func (s *quicSessionAdapter) report() {
+	if s.listener != nil {
+		s.listener.OnTCPSocketClosed(&tcpTrafficStats{
+			DownloadBytes: s.stats.downloadBytes.Load(),
+			UploadBytes:   s.stats.uploadBytes.Load(),
+			Duration:      int32(time.Since(s.beginTime)),
+			ServerPort:    -1, // the resolver's port isn't a per-flow destination worth bucketing
+		})
+	}
+	if s.sniReporter != nil {
+		serverName := s.EarlyConnection.ConnectionState().TLS.ServerName
+		s.sniReporter.Report(tcpTrafficStats{Retry: &split.RetryStats{SNI: serverName}})
+	}
+}
+
+func (s *quicSessionAdapter) CloseWithError(code quic.ApplicationErrorCode, msg string) error {
+	log.Printf("[debug] DoH3 session [%p] terminating...\n", s)
+	defer s.close(&s.wDone)
+	defer s.close(&s.rDone)
+	return s.EarlyConnection.CloseWithError(code, msg)
+}
+
+func (s *quicSessionAdapter) close(done *atomic.Bool) {
+	// make sure s.wg is being called at most once for a specific `done` flag
+	if done.CompareAndSwap(false, true) {
+		s.wg.Done()
+	}
+}
@@ -20,9 +20,12 @@ import (
 	"log"
 	"net"
 	"net/netip"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/classify"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/conntrack"
 	intraLegacy "github.com/Jigsaw-Code/outline-go-tun2socks/intra"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/protect"
 	"github.com/Jigsaw-Code/outline-sdk/network"
@@ -33,18 +36,28 @@ type DoHPacketProxy interface {
 	network.PacketProxy
 
 	SetDoHTransport(DoHTransport) error
+	// SetDoHTransportPool replaces the fixed DoH transport with a pool of
+	// transports, selected per query by measured health (see
+	// transportPool). At least one transport is required.
+	SetDoHTransportPool(transports []DoHTransport, mode TransportSelectionMode) error
+	// SetRouter installs a Router that can override, per query, which DoH
+	// transport answers a UDP DNS query. Pass nil to go back to the fixed
+	// DoH transport configured at construction time.
+	SetRouter(Router) error
 }
 
 type dohPacketProxy struct {
 	fakeDNSAddr netip.AddrPort
-	dohServer   atomic.Pointer[DoHTransport]
+	dohServer   atomic.Pointer[transportPool]
+	router      atomic.Pointer[Router]
 	proxy       network.PacketProxy
 	listener    intraLegacy.UDPListener
+	conntrack   *conntrack.Table
 }
 
 var _ DoHPacketProxy = (*dohPacketProxy)(nil)
 
-func MakeDoHPacketProxy(fakeDNS netip.AddrPort, dohServer DoHTransport, protector Protector, listener intraLegacy.UDPListener) (DoHPacketProxy, error) {
+func MakeDoHPacketProxy(fakeDNS netip.AddrPort, dohServer DoHTransport, protector Protector, listener intraLegacy.UDPListener, ct *conntrack.Table) (DoHPacketProxy, error) {
 	if dohServer == nil {
 		return nil, errors.New("dohServer is required")
 	}
@@ -63,8 +76,11 @@ func MakeDoHPacketProxy(fakeDNS netip.AddrPort, dohServer DoHTransport, protecto
 		fakeDNSAddr: fakeDNS,
 		proxy:       pp,
 		listener:    listener,
+		conntrack:   ct,
+	}
+	if err := dohpp.SetDoHTransport(dohServer); err != nil {
+		return nil, err
 	}
-	dohpp.dohServer.Store(&dohServer)
 
 	return dohpp, nil
 }
@@ -99,16 +115,80 @@ func (p *dohPacketProxy) SetDoHTransport(dohServer DoHTransport) error {
 	if dohServer == nil {
 		return errors.New("dohServer is required")
 	}
-	p.dohServer.Store(&dohServer)
-	log.Println("[info] DoH server updated for UDP sessions")
+	return p.SetDoHTransportPool([]DoHTransport{dohServer}, PrimaryFallback)
+}
+
+// SetDoHTransportPool implements DoHPacketProxy.SetDoHTransportPool.
+func (p *dohPacketProxy) SetDoHTransportPool(transports []DoHTransport, mode TransportSelectionMode) error {
+	pool, err := newTransportPool(transports, mode)
+	if err != nil {
+		return err
+	}
+	p.dohServer.Store(pool)
+	log.Printf("[info] DoH transport pool updated for UDP sessions (%d members)\n", len(transports))
 	return nil
 }
 
+// SetRouter implements DoHPacketProxy.SetRouter.
+func (p *dohPacketProxy) SetRouter(router Router) error {
+	p.router.Store(&router)
+	log.Println("[info] router updated for UDP sessions")
+	return nil
+}
+
+// loadRouter returns the Router installed by SetRouter, or nil if none has
+// been (or it was cleared by passing nil).
+func (p *dohPacketProxy) loadRouter() Router {
+	rp := p.router.Load()
+	if rp == nil {
+		return nil
+	}
+	return *rp
+}
+
 // DoH UDP session statistics data
 type udpTrafficStats struct {
 	sessionStartTime time.Time
 	downloadBytes    atomic.Int64
 	uploadBytes      atomic.Int64
+
+	// classified is set once the session's first upload packet has been
+	// checked against classify.MatchQUICInitial, so Close can attach the
+	// verdict to the UDPSocketSummary it reports to the listener.
+	classified atomic.Bool
+	protocol   atomic.Value // string
+
+	// flowOnce guards lazily registering this session with the conntrack
+	// table, which can only happen once the destination is known (on the
+	// first WriteTo, since NewSession isn't given an address).
+	flowOnce sync.Once
+	flow     conntrack.Handle
+}
+
+// startFlow lazily registers the session with ct under tuple, the first
+// time it is called for a given session. Later calls are no-ops.
+func (s *udpTrafficStats) startFlow(ct *conntrack.Table, tuple conntrack.FiveTuple) conntrack.Handle {
+	s.flowOnce.Do(func() {
+		s.flow = ct.Start(tuple, makeTCPTrafficStats(tuple.Dst).ServerPort)
+		s.flow.SetEstablished() // UDP has no handshake to wait for
+	})
+	return s.flow
+}
+
+// classify inspects the first upload packet of a UDP session and records
+// whether it looks like a QUIC Initial packet. UDP sessions are
+// request/response, so unlike the TCP classifier this needs only a single
+// packet rather than an accumulating buffer.
+func (s *udpTrafficStats) classify(p []byte) {
+	if !s.classified.CompareAndSwap(false, true) {
+		return
+	}
+	protocol := "unknown"
+	if classify.MatchQUICInitial(p) {
+		protocol = "quic-initial"
+	}
+	s.protocol.Store(protocol)
+	s.flow.SetClassification(protocol, "", "")
 }
 
 // DoH PacketRequestSender wrapper
@@ -144,7 +224,19 @@ func (req *dohPacketReqSender) WriteTo(p []byte, destination netip.AddrPort) (in
 		}()
 
 		log.Println("[debug] Doing DNS request over DoH server...")
-		resp, err := (*req.proxy.dohServer.Load()).Query(p)
+		var server DoHTransport = req.proxy.dohServer.Load()
+		router := req.proxy.loadRouter()
+		if router != nil {
+			if domain, ok := questionName(p); ok {
+				if s, _, matched := router.MatchDNSQuery(domain); matched {
+					// A router match names one specific transport, bypassing
+					// the pool's own health-based selection for this query.
+					server = s
+				}
+			}
+		}
+
+		resp, err := server.Query(p)
 		if err != nil {
 			log.Printf("[error] DoH request failed: %v\n", err)
 			return 0, fmt.Errorf("DoH request error: %w", err)
@@ -153,6 +245,11 @@ func (req *dohPacketReqSender) WriteTo(p []byte, destination netip.AddrPort) (in
 			log.Println("[error] DoH response is empty")
 			return 0, errors.New("empty DoH response")
 		}
+		if router != nil {
+			if addrs, domain, ok := answerAddrs(resp); ok {
+				router.RecordDNSAnswer(domain, addrs)
+			}
+		}
 
 		log.Printf("[info] Write DoH response (%v bytes) from %v\n", len(resp), req.proxy.fakeDNSAddr)
 		return req.response.writeFrom(resp, net.UDPAddrFromAddrPort(req.proxy.fakeDNSAddr), false)
@@ -160,6 +257,9 @@ func (req *dohPacketReqSender) WriteTo(p []byte, destination netip.AddrPort) (in
 
 	log.Printf("[debug] UDP Session: upload %v bytes to %v\n", len(p), destination)
 	req.stats.uploadBytes.Add(int64(len(p)))
+	flow := req.stats.startFlow(req.proxy.conntrack, conntrack.FiveTuple{Proto: "udp", Dst: destination})
+	flow.Touch(true, len(p))
+	req.stats.classify(p)
 	return req.PacketRequestSender.WriteTo(p, destination)
 }
 
@@ -168,12 +268,20 @@ func (resp *dohPacketRespReceiver) Close() error {
 	defer log.Printf("[info] UDP session terminated, stats = %v\n", resp.stats)
 	log.Println("[debug] UDP session terminating...")
 	if resp.listener != nil {
-		resp.listener.OnUDPSocketClosed(&intraLegacy.UDPSocketSummary{
+		summary := &intraLegacy.UDPSocketSummary{
 			Duration:      int32(time.Since(resp.stats.sessionStartTime)),
 			UploadBytes:   resp.stats.uploadBytes.Load(),
 			DownloadBytes: resp.stats.downloadBytes.Load(),
-		})
+		}
+		protocol, _ := resp.stats.protocol.Load().(string)
+		if protocol == "" {
+			protocol = classify.Unknown.Protocol
+		}
+		classify.Record(summary, classify.Result{Protocol: protocol})
+		resp.listener.OnUDPSocketClosed(summary)
+		classify.Forget(summary)
 	}
+	resp.stats.flow.Remove()
 	return resp.PacketResponseReceiver.Close()
 }
 
@@ -188,6 +296,7 @@ func (resp *dohPacketRespReceiver) writeFrom(p []byte, source net.Addr, doStat b
 	if doStat {
 		log.Printf("[debug] UDP Session: download %v bytes from %v\n", len(p), source)
 		resp.stats.downloadBytes.Add(int64(len(p)))
+		resp.stats.flow.Touch(false, len(p))
 	}
 	return resp.PacketResponseReceiver.WriteFrom(p, source)
 }
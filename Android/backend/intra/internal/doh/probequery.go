@@ -0,0 +1,84 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// paddingBlockSize is the EDNS0 padding (RFC 7830) block size BuildQuery
+// pads its query to, the common convention among stub resolvers that pad
+// queries to resist size-based fingerprinting.
+const paddingBlockSize = 128
+
+// BuildQuery builds a DNS wire-format query for qname/qtype with a random
+// query ID (so repeated probes aren't trivially matched against a cached
+// response) and an EDNS0 (RFC 6891) OPT record carrying an RFC 7830
+// padding option. It returns the packed message and the query ID used, so
+// a caller can match it against the eventual response.
+func BuildQuery(qname string, qtype dnsmessage.Type) (query []byte, id uint16, err error) {
+	var idBuf [2]byte
+	if _, err := rand.Read(idBuf[:]); err != nil {
+		return nil, 0, fmt.Errorf("failed to generate query ID: %w", err)
+	}
+	id = binary.BigEndian.Uint16(idBuf[:])
+
+	if !strings.HasSuffix(qname, ".") {
+		qname += "."
+	}
+	name, err := dnsmessage.NewName(qname)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid qname %q: %w", qname, err)
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, 0, fmt.Errorf("failed to start questions: %w", err)
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, 0, fmt.Errorf("failed to add question: %w", err)
+	}
+
+	if err := b.StartAdditionals(); err != nil {
+		return nil, 0, fmt.Errorf("failed to start additionals: %w", err)
+	}
+	var h dnsmessage.ResourceHeader
+	if err := h.SetEDNS0(4096, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, 0, fmt.Errorf("failed to set EDNS0 header: %w", err)
+	}
+	opt := dnsmessage.OPTResource{Options: []dnsmessage.Option{{Code: 12}}}
+	if err := b.OPTResource(h, opt); err != nil {
+		return nil, 0, fmt.Errorf("failed to add EDNS0 OPT record: %w", err)
+	}
+
+	query, err = b.Finish()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to pack query: %w", err)
+	}
+	// The padding option is the last thing packed: grow it so the whole
+	// query is a multiple of paddingBlockSize.
+	pad := (paddingBlockSize - len(query)%paddingBlockSize) % paddingBlockSize
+	n := len(query)
+	binary.BigEndian.PutUint16(query[n-2:], uint16(pad))   // padding option length
+	binary.BigEndian.PutUint16(query[n-6:], uint16(4+pad)) // OPT RDLENGTH
+	query = append(query, make([]byte, pad)...)
+	return query, id, nil
+}
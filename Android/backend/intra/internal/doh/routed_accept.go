@@ -0,0 +1,100 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net/netip"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// routedAccept is a Router-aware replacement for the legacy doh.Accept
+// loop used for DoT-over-DoH: it reads each length-prefixed DNS-over-TCP
+// query from conn (RFC 1035 section 4.2.2), uses router to pick which
+// DoHTransport answers it (falling back to defaultServer if no rule
+// matches), and records the answer's addresses with router so a later TCP
+// dial to one of them can still match a domain-based rule.
+func routedAccept(router Router, defaultServer DoHTransport, conn io.ReadWriteCloser) {
+	defer conn.Close()
+	for {
+		var lenBuf [2]byte
+		if _, err := io.ReadFull(conn, lenBuf[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(lenBuf[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		server := defaultServer
+		if domain, ok := questionName(query); ok {
+			if s, _, matched := router.MatchDNSQuery(domain); matched {
+				server = s
+			}
+		}
+
+		resp, err := server.Query(query)
+		if err != nil {
+			log.Printf("[error] routed DoH query failed: %v\n", err)
+			return
+		}
+		if addrs, domain, ok := answerAddrs(resp); ok {
+			router.RecordDNSAnswer(domain, addrs)
+		}
+
+		var respLenBuf [2]byte
+		binary.BigEndian.PutUint16(respLenBuf[:], uint16(len(resp)))
+		if _, err := conn.Write(respLenBuf[:]); err != nil {
+			return
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+// questionName returns the name queried by the first question in a DNS
+// message, if it has one.
+func questionName(msg []byte) (string, bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(msg); err != nil || len(m.Questions) == 0 {
+		return "", false
+	}
+	return m.Questions[0].Name.String(), true
+}
+
+// answerAddrs returns the A/AAAA addresses a DNS response answers its
+// query's domain with, if any.
+func answerAddrs(resp []byte) (addrs []netip.Addr, domain string, ok bool) {
+	var m dnsmessage.Message
+	if err := m.Unpack(resp); err != nil || len(m.Questions) == 0 {
+		return nil, "", false
+	}
+	for _, a := range m.Answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			addrs = append(addrs, netip.AddrFrom4(body.A))
+		case *dnsmessage.AAAAResource:
+			addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, "", false
+	}
+	return addrs, m.Questions[0].Name.String(), true
+}
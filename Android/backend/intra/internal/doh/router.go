@@ -0,0 +1,37 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import "net/netip"
+
+// Router lets a caller (internal/router.Router satisfies this) pick, rule
+// by rule, which DoH transport answers a fake-DNS query and which
+// transport config dials a port-443 destination - in place of the single
+// fixed dohServer/portDialer a dohSplitStreamDialer or dohPacketProxy
+// otherwise uses for every connection. See internal/router for the
+// concrete implementation and its rule syntax.
+type Router interface {
+	// MatchDNSQuery returns the DoHTransport that should answer a query for
+	// domain, and whether any rule matched.
+	MatchDNSQuery(domain string) (server DoHTransport, transportConfig string, ok bool)
+	// MatchDestination returns the transport config (see
+	// DefaultTransportConfig) that should be used dialing dest, and whether
+	// any rule matched.
+	MatchDestination(dest netip.AddrPort) (transportConfig string, ok bool)
+	// RecordDNSAnswer lets the Router associate a later dial to one of
+	// addrs with the domain that resolved to it, so rules written against a
+	// domain can still apply once only the resolved IP is available.
+	RecordDNSAnswer(domain string, addrs []netip.Addr)
+}
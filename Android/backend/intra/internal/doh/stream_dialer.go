@@ -21,46 +21,90 @@ import (
 	"log"
 	"net"
 	"net/netip"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/config"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/conntrack"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/metrics"
 	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/sni"
 	intraLegacy "github.com/Jigsaw-Code/outline-go-tun2socks/intra"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/protect"
-	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
 	"github.com/Jigsaw-Code/outline-sdk/transport"
 )
 
+// DefaultTransportConfig is the config string MakeDoHStreamDialer falls
+// back to when its caller doesn't supply one. It reproduces the dialer's
+// historical default behavior: retry port 443 connections with a split
+// ClientHello if the first attempt stalls, and dial everything else
+// directly.
+const DefaultTransportConfig = "splitretry"
+
 type DoHStreamDialer interface {
 	transport.StreamDialer
 
 	SetDoHTransport(DoHTransport) error
+	// SetRouter installs a Router that can override, per connection, which
+	// DoH transport answers the fake-DNS query and which transport config
+	// dials port 443. Pass nil to go back to the fixed DoH transport and
+	// transport config configured at construction time.
+	SetRouter(Router) error
 }
 
 type tcpTrafficStats = intraLegacy.TCPSocketSummary
 
 type dohSplitStreamDialer struct {
-	fakeDNSAddr      netip.AddrPort
-	dohServer        atomic.Pointer[DoHTransport]
-	dialer           *net.Dialer
-	alwaysSplitHTTPS atomic.Bool
-	listener         intraLegacy.TCPListener
-	sniReporter      sni.TCPSNIReporter
+	fakeDNSAddr netip.AddrPort
+	dohServer   atomic.Pointer[DoHTransport]
+	dialer      *net.Dialer
+	// portDialer is the dialer the "transportConfig" string passed to
+	// MakeDoHStreamDialer parses into: the chain of wrappers (e.g. split,
+	// splitretry, override) applied to port-443 destinations, so a new
+	// circumvention primitive is a config string change rather than a new
+	// branch in dial.
+	portDialer  transport.StreamDialer
+	listener    intraLegacy.TCPListener
+	sniReporter sni.TCPSNIReporter
+	conntrack   *conntrack.Table
+	metrics     *metrics.Registry
+
+	router atomic.Pointer[Router]
+	// routedPortDialers caches the transport.StreamDialer each distinct
+	// transport config string a Router's rules name parses into, so a rule
+	// matching repeatedly doesn't reparse its config string on every dial.
+	routedPortDialers sync.Map // string -> transport.StreamDialer
 }
 
 var _ DoHStreamDialer = (*dohSplitStreamDialer)(nil)
 
-func MakeDoHStreamDialer(fakeDNS netip.AddrPort, dohServer DoHTransport, protector Protector, listener intraLegacy.TCPListener, sniReporter sni.TCPSNIReporter) (DoHStreamDialer, error) {
+// MakeDoHStreamDialer builds a DoHStreamDialer. transportConfig is an
+// Outline-SDK style "|"-separated config string (see the config package)
+// describing the wrapper chain applied to port-443 destinations; an empty
+// string is equivalent to DefaultTransportConfig.
+func MakeDoHStreamDialer(fakeDNS netip.AddrPort, dohServer DoHTransport, protector Protector, listener intraLegacy.TCPListener, sniReporter sni.TCPSNIReporter, ct *conntrack.Table, m *metrics.Registry, transportConfig string) (DoHStreamDialer, error) {
 	if dohServer == nil {
 		return nil, errors.New("dohServer is required")
 	}
+	if transportConfig == "" {
+		transportConfig = DefaultTransportConfig
+	}
+
+	dialer := protect.MakeDialer(protector)
+	portDialer, err := config.NewDefaultStreamDialerParser(&transport.TCPStreamDialer{Dialer: *dialer}).Parse(context.Background(), transportConfig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid transport config: %w", err)
+	}
 
 	dohsd := &dohSplitStreamDialer{
 		fakeDNSAddr: fakeDNS,
-		dialer:      protect.MakeDialer(protector),
+		dialer:      dialer,
+		portDialer:  portDialer,
 		listener:    listener,
 		sniReporter: sniReporter,
+		conntrack:   ct,
+		metrics:     m,
 	}
 	dohsd.dohServer.Store(&dohServer)
 	return dohsd, nil
@@ -71,7 +115,11 @@ func (sd *dohSplitStreamDialer) Dial(ctx context.Context, raddr string) (transpo
 	if raddr == sd.fakeDNSAddr.String() {
 		log.Println("[debug] Doing DoT request over DoH server...")
 		conn := makeDoHQueryStreamConn()
-		go doh.Accept(*sd.dohServer.Load(), conn.serverConn)
+		if router := sd.loadRouter(); router != nil {
+			go routedAccept(router, *sd.dohServer.Load(), conn.serverConn)
+		} else {
+			go doh.Accept(*sd.dohServer.Load(), conn.serverConn)
+		}
 		return conn, nil
 	}
 
@@ -81,14 +129,20 @@ func (sd *dohSplitStreamDialer) Dial(ctx context.Context, raddr string) (transpo
 	}
 
 	stats := makeTCPTrafficStats(dest)
+	flow := sd.conntrack.Start(conntrack.FiveTuple{Proto: "tcp", Dst: dest}, stats.ServerPort)
 	beforeConn := time.Now()
 	conn, err := sd.dial(ctx, dest, stats)
 	if err != nil {
+		flow.Remove()
 		return nil, fmt.Errorf("failed to dial to target: %w", err)
 	}
 	stats.Synack = int32(time.Since(beforeConn).Milliseconds())
+	flow.SetEstablished()
+	if sd.metrics != nil {
+		sd.metrics.RecordDialRTT(time.Since(beforeConn))
+	}
 
-	return makeWrapConnWithStats(conn, stats, sd.listener, sd.sniReporter), nil
+	return makeWrapConnWithStats(conn, stats, sd.metrics, sd.listener, sd.sniReporter, flow), nil
 }
 
 // SetDoHTransport implements DoHStreamDialer.SetDoHTransport.
@@ -101,20 +155,62 @@ func (sd *dohSplitStreamDialer) SetDoHTransport(dohServer DoHTransport) error {
 	return nil
 }
 
+// SetRouter implements DoHStreamDialer.SetRouter.
+func (sd *dohSplitStreamDialer) SetRouter(router Router) error {
+	sd.router.Store(&router)
+	log.Println("[info] router updated for TCP sessions")
+	return nil
+}
+
+// loadRouter returns the Router installed by SetRouter, or nil if none has
+// been (or it was cleared by passing nil).
+func (sd *dohSplitStreamDialer) loadRouter() Router {
+	rp := sd.router.Load()
+	if rp == nil {
+		return nil
+	}
+	return *rp
+}
+
+// routedPortDialerFor returns the transport.StreamDialer transportConfig
+// parses into, reusing a cached one for a transportConfig seen before.
+func (sd *dohSplitStreamDialer) routedPortDialerFor(transportConfig string) (transport.StreamDialer, error) {
+	if cached, ok := sd.routedPortDialers.Load(transportConfig); ok {
+		return cached.(transport.StreamDialer), nil
+	}
+	d, err := config.NewDefaultStreamDialerParser(&transport.TCPStreamDialer{Dialer: *sd.dialer}).Parse(context.Background(), transportConfig)
+	if err != nil {
+		return nil, err
+	}
+	sd.routedPortDialers.Store(transportConfig, d)
+	return d, nil
+}
+
 func (sd *dohSplitStreamDialer) dial(ctx context.Context, dest netip.AddrPort, stats *tcpTrafficStats) (transport.StreamConn, error) {
 	if dest.Port() == 443 {
-		if sd.alwaysSplitHTTPS.Load() {
-			return split.DialWithSplit(sd.dialer, net.TCPAddrFromAddrPort(dest))
-		} else {
-			stats.Retry = &split.RetryStats{}
-			return split.DialWithSplitRetry(sd.dialer, net.TCPAddrFromAddrPort(dest), stats.Retry)
+		portDialer := sd.portDialer
+		if router := sd.loadRouter(); router != nil {
+			if transportConfig, ok := router.MatchDestination(dest); ok {
+				routed, err := sd.routedPortDialerFor(transportConfig)
+				if err != nil {
+					return nil, fmt.Errorf("invalid routed transport config: %w", err)
+				}
+				portDialer = routed
+			}
 		}
-	} else {
-		tcpsd := &transport.TCPStreamDialer{
-			Dialer: *sd.dialer,
+
+		conn, err := portDialer.Dial(ctx, dest.String())
+		if err != nil {
+			return nil, err
 		}
-		return tcpsd.Dial(ctx, dest.String())
+		stats.Retry = config.RetryStatsOf(conn)
+		return conn, nil
+	}
+
+	tcpsd := &transport.TCPStreamDialer{
+		Dialer: *sd.dialer,
 	}
+	return tcpsd.Dial(ctx, dest.String())
 }
 
 func makeTCPTrafficStats(dest netip.AddrPort) *tcpTrafficStats {
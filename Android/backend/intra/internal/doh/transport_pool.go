@@ -0,0 +1,265 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package doh
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TransportSelectionMode controls how a transportPool picks among its
+// member DoHTransports for each query.
+type TransportSelectionMode int
+
+const (
+	// PrimaryFallback always uses the first healthy member, in order,
+	// falling through to the next healthy member when a query to it fails.
+	// A member whose circuit breaker has tripped is skipped.
+	PrimaryFallback TransportSelectionMode = iota
+	// Race dispatches each query to the two healthiest members concurrently
+	// and returns whichever responds first. DoHTransport.Query takes no
+	// context, so the loser can't be cancelled; it's left to finish (and be
+	// discarded) on its own.
+	Race
+	// WeightedRandom picks among healthy members with probability
+	// proportional to 1/EWMA-latency, favoring faster servers without
+	// starving slower ones entirely.
+	WeightedRandom
+)
+
+const (
+	// transportCircuitBreakerThreshold is the number of consecutive
+	// failures after which a member is treated as unhealthy.
+	transportCircuitBreakerThreshold = 3
+	// transportCircuitBreakerCooldown is how long a tripped member is
+	// skipped for before getting another chance.
+	transportCircuitBreakerCooldown = 30 * time.Second
+	// transportLatencyEWMAAlpha weights how quickly the latency EWMA
+	// reacts to a new sample; smaller values smooth out noise more.
+	transportLatencyEWMAAlpha = 0.3
+)
+
+// transportMember tracks one transportPool member's measured health.
+type transportMember struct {
+	transport DoHTransport
+
+	mu                  sync.Mutex
+	ewmaLatency         float64
+	hasLatencySample    bool
+	consecutiveFailures int
+	circuitOpenUntil    time.Time
+}
+
+func (m *transportMember) healthy(now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return now.After(m.circuitOpenUntil)
+}
+
+// weight returns this member's selection weight for WeightedRandom: zero if
+// its circuit is open, 1 (a neutral default) if it has no latency samples
+// yet, and 1/latency otherwise.
+func (m *transportMember) weight(now time.Time) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if now.Before(m.circuitOpenUntil) {
+		return 0
+	}
+	if !m.hasLatencySample {
+		return 1
+	}
+	const epsilon = 1e-3 // avoid dividing by ~0 for a very fast local resolver
+	return 1 / (m.ewmaLatency + epsilon)
+}
+
+// record updates the member's health from one completed query's latency and
+// outcome.
+func (m *transportMember) record(latency time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sample := latency.Seconds()
+	if !m.hasLatencySample {
+		m.ewmaLatency = sample
+		m.hasLatencySample = true
+	} else {
+		m.ewmaLatency = transportLatencyEWMAAlpha*sample + (1-transportLatencyEWMAAlpha)*m.ewmaLatency
+	}
+
+	if err == nil {
+		m.consecutiveFailures = 0
+		m.circuitOpenUntil = time.Time{}
+		return
+	}
+	m.consecutiveFailures++
+	if m.consecutiveFailures >= transportCircuitBreakerThreshold {
+		m.circuitOpenUntil = time.Now().Add(transportCircuitBreakerCooldown)
+	}
+}
+
+// transportPool is a DoHTransport that spreads queries across one or more
+// underlying DoHTransports, selecting among them by measured health (EWMA
+// latency and a consecutive-failures circuit breaker) instead of querying
+// the same fixed transport every time. A pool of one member (the common
+// case, built by SetDoHTransport) behaves exactly like querying that
+// transport directly.
+//
+// This mirrors Android/app/src/go/doh's TransportPool, but can't share code
+// with it: that package's Resolver/Query(ctx, q) is a different type from
+// this package's DoHTransport (an alias for
+// github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh.Transport, whose
+// Query takes no context), and the two trees are independent Go modules.
+type transportPool struct {
+	members []*transportMember
+	mode    TransportSelectionMode
+}
+
+var _ DoHTransport = (*transportPool)(nil)
+
+// NewTransportPool builds a DoHTransport that pools transports, selecting
+// among them per mode - the same machinery SetDoHTransportPool uses, exposed
+// for callers outside this package (e.g. DoHServer) that want to pool more
+// than one transport themselves, such as an H3Transport falling back to a
+// plain HTTP/2 one. At least one transport is required.
+func NewTransportPool(transports []DoHTransport, mode TransportSelectionMode) (DoHTransport, error) {
+	return newTransportPool(transports, mode)
+}
+
+// newTransportPool builds a transportPool over transports, selecting among
+// them per mode. At least one transport is required.
+func newTransportPool(transports []DoHTransport, mode TransportSelectionMode) (*transportPool, error) {
+	if len(transports) == 0 {
+		return nil, errors.New("at least one DoH transport is required")
+	}
+	p := &transportPool{mode: mode}
+	for _, t := range transports {
+		p.members = append(p.members, &transportMember{transport: t})
+	}
+	return p, nil
+}
+
+// GetURL implements DoHTransport.GetURL, returning the primary (first)
+// member's URL. A transportPool has no single canonical URL; this is only
+// meant for diagnostic logging.
+func (p *transportPool) GetURL() string {
+	return p.members[0].transport.GetURL()
+}
+
+// Query implements DoHTransport.Query, selecting among the pool's members
+// according to its TransportSelectionMode.
+func (p *transportPool) Query(q []byte) ([]byte, error) {
+	now := time.Now()
+	switch p.mode {
+	case Race:
+		return p.queryRace(q, now)
+	case WeightedRandom:
+		m := p.members[p.pickWeighted(now)]
+		return p.queryMember(m, q)
+	default: // PrimaryFallback
+		return p.queryPrimaryFallback(q, now)
+	}
+}
+
+// queryRace dispatches q to the two healthiest members and returns
+// whichever answers first.
+func (p *transportPool) queryRace(q []byte, now time.Time) ([]byte, error) {
+	ranked := p.membersByHealth(now)
+	n := 2
+	if len(ranked) < n {
+		n = len(ranked)
+	}
+
+	type raceResult struct {
+		resp []byte
+		err  error
+	}
+	results := make(chan raceResult, n)
+	for _, m := range ranked[:n] {
+		m := m
+		go func() {
+			resp, err := p.queryMember(m, q)
+			results <- raceResult{resp, err}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < n; i++ {
+		res := <-results
+		if res.err == nil {
+			return res.resp, nil
+		}
+		lastErr = res.err
+	}
+	return nil, lastErr
+}
+
+// membersByHealth returns the pool's members ranked from healthiest to
+// least healthy, by the same weight used for WeightedRandom selection.
+func (p *transportPool) membersByHealth(now time.Time) []*transportMember {
+	ranked := make([]*transportMember, len(p.members))
+	copy(ranked, p.members)
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].weight(now) > ranked[j].weight(now) })
+	return ranked
+}
+
+func (p *transportPool) queryMember(m *transportMember, q []byte) ([]byte, error) {
+	before := time.Now()
+	resp, err := m.transport.Query(q)
+	m.record(time.Since(before), err)
+	return resp, err
+}
+
+func (p *transportPool) queryPrimaryFallback(q []byte, now time.Time) ([]byte, error) {
+	var last error
+	for _, m := range p.members {
+		if !m.healthy(now) {
+			continue
+		}
+		resp, err := p.queryMember(m, q)
+		if err == nil {
+			return resp, nil
+		}
+		last = err
+	}
+	if last != nil {
+		return nil, last
+	}
+	// Every member is circuit-broken; try the first one anyway, rather than
+	// failing outright just because our own health tracking gave up on it.
+	return p.queryMember(p.members[0], q)
+}
+
+func (p *transportPool) pickWeighted(now time.Time) int {
+	weights := make([]float64, len(p.members))
+	var total float64
+	for i, m := range p.members {
+		weights[i] = m.weight(now)
+		total += weights[i]
+	}
+	if total <= 0 {
+		return 0
+	}
+	r := rand.Float64() * total
+	for i, w := range weights {
+		r -= w
+		if r <= 0 {
+			return i
+		}
+	}
+	return len(p.members) - 1
+}
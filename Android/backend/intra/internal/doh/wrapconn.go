@@ -21,6 +21,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/classify"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/conntrack"
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/metrics"
 	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/sni"
 	intraLegacy "github.com/Jigsaw-Code/outline-go-tun2socks/intra"
 	"github.com/Jigsaw-Code/outline-sdk/transport"
@@ -32,16 +35,28 @@ type dohConnAdapter struct {
 	wg           *sync.WaitGroup
 	rDone, wDone atomic.Bool
 
-	beginTime time.Time
-	stats     *tcpTrafficStats
+	beginTime     time.Time
+	firstByteOnce sync.Once
+	stats         *tcpTrafficStats
+	metrics       *metrics.Registry
 
 	listener    intraLegacy.TCPListener
 	sniReporter sni.TCPSNIReporter
+	flow        conntrack.Handle
+
+	// classifier identifies the flow's L7 protocol. Read and Write both feed
+	// this one classifier, so upload and download bytes are appended to a
+	// single buffer in the order they pass through; the two directions are
+	// not classified separately. classifierMu guards it, including each
+	// Feed. It is nil once classification has completed, so that Read/Write
+	// can skip the (tiny) overhead on the steady-state path.
+	classifierMu sync.Mutex
+	classifier   *classify.Classifier
 }
 
 var _ transport.StreamConn = (*dohConnAdapter)(nil)
 
-func makeWrapConnWithStats(c transport.StreamConn, stats *tcpTrafficStats, listener intraLegacy.TCPListener, sniReporter sni.TCPSNIReporter) (conn *dohConnAdapter) {
+func makeWrapConnWithStats(c transport.StreamConn, stats *tcpTrafficStats, m *metrics.Registry, listener intraLegacy.TCPListener, sniReporter sni.TCPSNIReporter, flow conntrack.Handle) (conn *dohConnAdapter) {
 	log.Println("[debug] establishing new TCP session")
 	defer func() {
 		log.Printf("[info] New TCP session [%p] initialized\n", conn)
@@ -52,8 +67,11 @@ func makeWrapConnWithStats(c transport.StreamConn, stats *tcpTrafficStats, liste
 		wg:          &sync.WaitGroup{},
 		beginTime:   time.Now(),
 		stats:       stats,
+		metrics:     m,
 		listener:    listener,
 		sniReporter: sniReporter,
+		flow:        flow,
+		classifier:  classify.New(classify.DefaultBudget),
 	}
 
 	// Wait until both read and write are done
@@ -69,14 +87,52 @@ func makeWrapConnWithStats(c transport.StreamConn, stats *tcpTrafficStats, liste
 		if conn.listener != nil {
 			conn.listener.OnTCPSocketClosed(conn.stats)
 		}
-		if conn.stats.Retry != nil && conn.sniReporter != nil {
-			conn.sniReporter.Report(*conn.stats)
+		if conn.stats.Retry != nil {
+			if conn.sniReporter != nil {
+				conn.sniReporter.Report(*conn.stats)
+			}
+			conn.flow.SetRetry(conntrack.RetryStats{
+				SNI:     conn.stats.Retry.SNI,
+				Bytes:   conn.stats.Retry.Bytes,
+				Chunks:  conn.stats.Retry.Chunks,
+				Split:   conn.stats.Retry.Split,
+				Timeout: conn.stats.Retry.Timeout,
+			})
+			if conn.metrics != nil {
+				conn.metrics.RecordRetry(conn.stats.Retry.Timeout)
+			}
 		}
+		if conn.metrics != nil {
+			conn.metrics.RecordSession(conn.stats.UploadBytes, conn.stats.DownloadBytes)
+			if result, ok := classify.Lookup(conn.stats); ok {
+				conn.metrics.RecordSNI(result.TLSServerName)
+			}
+		}
+		classify.Forget(conn.stats)
+		conn.flow.Remove()
 	}()
 
 	return
 }
 
+// classify feeds b into the connection's classifier (if classification
+// hasn't already finished) and, once a verdict is reached, records it under
+// conn.stats so the outer EventListener adapter can retrieve it when this
+// flow's TCPSocketStats is eventually built.
+func (conn *dohConnAdapter) classify(b []byte) {
+	conn.classifierMu.Lock()
+	defer conn.classifierMu.Unlock()
+	c := conn.classifier
+	if c == nil || len(b) == 0 {
+		return
+	}
+	if result, done := c.Feed(b); done {
+		classify.Record(conn.stats, result)
+		conn.flow.SetClassification(result.Protocol, result.TLSServerName, result.TLSALPN)
+		conn.classifier = nil
+	}
+}
+
 func (conn *dohConnAdapter) Close() error {
 	log.Printf("[debug] TCP session [%p] terminating...\n", conn)
 	defer conn.close(&conn.wDone)
@@ -101,6 +157,11 @@ func (conn *dohConnAdapter) Read(b []byte) (n int, err error) {
 	defer func() {
 		log.Printf("[debug] TCP Session [%p]: download %v bytes, with err = %v\n", conn, n, err)
 		conn.stats.DownloadBytes += int64(n)
+		conn.flow.Touch(false, n)
+		conn.classify(b[:n])
+		if n > 0 && conn.metrics != nil {
+			conn.firstByteOnce.Do(func() { conn.metrics.RecordFirstByte(time.Since(conn.beginTime)) })
+		}
 	}()
 	return conn.StreamConn.Read(b)
 }
@@ -110,6 +171,7 @@ func (conn *dohConnAdapter) WriteTo(w io.Writer) (n int64, err error) {
 	defer func() {
 		log.Printf("[debug] TCP Session [%p]: download %v bytes, with err = %v\n", conn, n, err)
 		conn.stats.DownloadBytes += n
+		conn.flow.Touch(false, int(n))
 	}()
 	return io.Copy(w, conn.StreamConn)
 }
@@ -119,6 +181,8 @@ func (conn *dohConnAdapter) Write(b []byte) (n int, err error) {
 	defer func() {
 		log.Printf("[debug] TCP Session [%p]: upload %v bytes, with err = %v\n", conn, n, err)
 		conn.stats.UploadBytes += int64(n)
+		conn.flow.Touch(true, n)
+		conn.classify(b[:n])
 	}()
 	return conn.StreamConn.Write(b)
 }
@@ -128,8 +192,22 @@ func (conn *dohConnAdapter) ReadFrom(r io.Reader) (n int64, err error) {
 	defer func() {
 		log.Printf("[debug] TCP Session [%p]: upload %v bytes, with err = %v\n", conn, n, err)
 		conn.stats.UploadBytes += n
+		conn.flow.Touch(true, int(n))
 	}()
-	return io.Copy(conn.StreamConn, r)
+	// io.Copy never hands us the bytes it moves directly, so tee them through
+	// classify as they pass, the same way Write classifies its argument.
+	return io.Copy(conn.StreamConn, io.TeeReader(r, classifyWriter{conn}))
+}
+
+// classifyWriter adapts dohConnAdapter.classify to an io.Writer so ReadFrom
+// can observe upload-direction bytes via io.TeeReader without buffering them.
+type classifyWriter struct {
+	conn *dohConnAdapter
+}
+
+func (w classifyWriter) Write(p []byte) (int, error) {
+	w.conn.classify(p)
+	return len(p), nil
 }
 
 func (conn *dohConnAdapter) close(done *atomic.Bool) {
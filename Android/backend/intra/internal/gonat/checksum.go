@@ -0,0 +1,55 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import "net/netip"
+
+// checksum computes the RFC 1071 Internet checksum of data, starting from
+// the given partial sum (so callers can fold a pseudo-header in first) and
+// returns the ones' complement of the folded result.
+func checksum(data []byte, initial uint32) uint16 {
+	sum := initial
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// pseudoHeaderSum returns the partial checksum contribution of the TCP/UDP
+// pseudo-header (RFC 793 §3.1, RFC 768) for a segment from src to dst,
+// carrying protocol (6 for TCP, 17 for UDP) and length bytes of payload.
+// It works for both IPv4 and IPv6 addresses: summing the length as a single
+// 16- or 32-bit value is equivalent mod 0xffff to summing it as the
+// wire-format sequence of 16-bit words, which is all the final fold cares
+// about.
+func pseudoHeaderSum(src, dst netip.Addr, protocol uint8, length int) uint32 {
+	var sum uint32
+	addWords := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(b[i])<<8 | uint32(b[i+1])
+		}
+	}
+	addWords(src.AsSlice())
+	addWords(dst.AsSlice())
+	sum += uint32(protocol)
+	sum += uint32(length)
+	return sum
+}
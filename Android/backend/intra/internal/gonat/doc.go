@@ -0,0 +1,29 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gonat is a pure-Go, cgo-free alternative to
+// [lwip2transport.ConfigureDevice]: it implements just enough of IPv4/IPv6,
+// TCP, and UDP to terminate the tun device's packets itself and relay their
+// payloads through a [transport.StreamDialer]/[network.PacketProxy], instead
+// of linking lwIP to do the same reassembly.
+//
+// It is not a general-purpose TCP/IP stack. Notably, it keeps no
+// out-of-order reassembly buffer (an out-of-order TCP segment is dropped,
+// relying on the client's own retransmission, same as a lossy link would),
+// does not implement congestion control beyond a fixed send window, and
+// does not reassemble IP fragments. This is an acceptable trade for a VPN
+// client's tun device, where the "network" between the OS and this process
+// is a local, in-order, non-lossy pipe - the conditions that make those
+// features necessary on a real NIC don't apply here.
+package gonat
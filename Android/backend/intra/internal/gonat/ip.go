@@ -0,0 +1,145 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+const (
+	protoTCP = 6
+	protoUDP = 17
+
+	ipv4HeaderLen = 20
+	ipv6HeaderLen = 40
+)
+
+// ipPacket is the result of parsing an IPv4 or IPv6 header: enough to
+// identify the flow and to rebuild a matching header for the return path.
+type ipPacket struct {
+	isV6     bool
+	src      netip.Addr
+	dst      netip.Addr
+	protocol uint8
+	payload  []byte // the TCP/UDP segment, header included
+}
+
+// parseIP parses the IPv4 or IPv6 header at the start of pkt. IPv6 extension
+// headers are not walked - a packet with one is rejected - since the tun
+// device only ever carries plain TCP/UDP traffic this stack originates
+// itself downstream.
+func parseIP(pkt []byte) (ipPacket, error) {
+	if len(pkt) == 0 {
+		return ipPacket{}, errors.New("empty packet")
+	}
+	switch pkt[0] >> 4 {
+	case 4:
+		return parseIPv4(pkt)
+	case 6:
+		return parseIPv6(pkt)
+	default:
+		return ipPacket{}, errors.New("not an IPv4 or IPv6 packet")
+	}
+}
+
+func parseIPv4(pkt []byte) (ipPacket, error) {
+	if len(pkt) < ipv4HeaderLen {
+		return ipPacket{}, errors.New("ipv4 packet shorter than a header")
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if ihl < ipv4HeaderLen || len(pkt) < ihl {
+		return ipPacket{}, errors.New("invalid ipv4 header length")
+	}
+	totalLength := int(binary.BigEndian.Uint16(pkt[2:4]))
+	if totalLength < ihl || totalLength > len(pkt) {
+		totalLength = len(pkt)
+	}
+	flagsAndFrag := binary.BigEndian.Uint16(pkt[6:8])
+	if flagsAndFrag&0x1fff != 0 || flagsAndFrag&0x2000 != 0 {
+		return ipPacket{}, errors.New("fragmented ipv4 packets are not supported")
+	}
+	return ipPacket{
+		src:      netip.AddrFrom4([4]byte(pkt[12:16])),
+		dst:      netip.AddrFrom4([4]byte(pkt[16:20])),
+		protocol: pkt[9],
+		payload:  pkt[ihl:totalLength],
+	}, nil
+}
+
+func parseIPv6(pkt []byte) (ipPacket, error) {
+	if len(pkt) < ipv6HeaderLen {
+		return ipPacket{}, errors.New("ipv6 packet shorter than a header")
+	}
+	payloadLength := int(binary.BigEndian.Uint16(pkt[4:6]))
+	end := ipv6HeaderLen + payloadLength
+	if end < ipv6HeaderLen || end > len(pkt) {
+		end = len(pkt)
+	}
+	return ipPacket{
+		isV6:     true,
+		src:      netip.AddrFrom16([16]byte(pkt[8:24])),
+		dst:      netip.AddrFrom16([16]byte(pkt[24:40])),
+		protocol: pkt[6],
+		payload:  pkt[ipv6HeaderLen:end],
+	}, nil
+}
+
+// buildIPv4 prepends an IPv4 header for a protocol segment of payload from
+// src to dst, and returns the full packet.
+func buildIPv4(src, dst netip.Addr, protocol uint8, payload []byte) []byte {
+	totalLength := ipv4HeaderLen + len(payload)
+	pkt := make([]byte, totalLength)
+	pkt[0] = 0x45 // version 4, IHL 5 (no options)
+	pkt[1] = 0    // DSCP/ECN
+	binary.BigEndian.PutUint16(pkt[2:4], uint16(totalLength))
+	binary.BigEndian.PutUint16(pkt[4:6], 0)      // identification; fragmentation isn't used here
+	binary.BigEndian.PutUint16(pkt[6:8], 0x4000) // don't-fragment, no offset
+	pkt[8] = 64                                  // TTL
+	pkt[9] = protocol
+	src4 := src.As4()
+	dst4 := dst.As4()
+	copy(pkt[12:16], src4[:])
+	copy(pkt[16:20], dst4[:])
+	binary.BigEndian.PutUint16(pkt[10:12], checksum(pkt[:ipv4HeaderLen], 0))
+	copy(pkt[ipv4HeaderLen:], payload)
+	return pkt
+}
+
+// buildIPv6 prepends an IPv6 header for a protocol segment of payload from
+// src to dst, and returns the full packet.
+func buildIPv6(src, dst netip.Addr, protocol uint8, payload []byte) []byte {
+	pkt := make([]byte, ipv6HeaderLen+len(payload))
+	pkt[0] = 0x60 // version 6, traffic class/flow label 0
+	binary.BigEndian.PutUint16(pkt[4:6], uint16(len(payload)))
+	pkt[6] = protocol
+	pkt[7] = 64 // hop limit
+	src16 := src.As16()
+	dst16 := dst.As16()
+	copy(pkt[8:24], src16[:])
+	copy(pkt[24:40], dst16[:])
+	copy(pkt[ipv6HeaderLen:], payload)
+	return pkt
+}
+
+// buildIP prepends an IPv4 or IPv6 header matching isV6, mirroring
+// buildIPv4/buildIPv6.
+func buildIP(isV6 bool, src, dst netip.Addr, protocol uint8, payload []byte) []byte {
+	if isV6 {
+		return buildIPv6(src, dst, protocol, payload)
+	}
+	return buildIPv4(src, dst, protocol, payload)
+}
@@ -0,0 +1,195 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestChecksumKnownValue(t *testing.T) {
+	// RFC 1071 §3's worked example.
+	data := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if got, want := checksum(data, 0), uint16(0x220d); got != want {
+		t.Errorf("checksum = %#04x, want %#04x", got, want)
+	}
+}
+
+func TestChecksumOddLength(t *testing.T) {
+	// An odd-length buffer pads its last byte as the high byte of a 16-bit
+	// word; a one-byte buffer and its two-byte, zero-padded equivalent must
+	// checksum the same.
+	odd := []byte{0xab}
+	padded := []byte{0xab, 0x00}
+	if got, want := checksum(odd, 0), checksum(padded, 0); got != want {
+		t.Errorf("checksum(odd) = %#04x, want %#04x (checksum of zero-padded equivalent)", got, want)
+	}
+}
+
+func TestBuildIPv4ParseRoundTrip(t *testing.T) {
+	src := netip.MustParseAddr("10.0.0.1")
+	dst := netip.MustParseAddr("10.0.0.2")
+	payload := []byte("hello")
+
+	pkt := buildIPv4(src, dst, protoTCP, payload)
+	got, err := parseIP(pkt)
+	if err != nil {
+		t.Fatalf("parseIP: %v", err)
+	}
+	if got.src != src || got.dst != dst || got.protocol != protoTCP {
+		t.Errorf("parsed = %+v, want src=%v dst=%v protocol=%d", got, src, dst, protoTCP)
+	}
+	if string(got.payload) != string(payload) {
+		t.Errorf("parsed payload = %q, want %q", got.payload, payload)
+	}
+
+	// The header checksum field itself must make the whole header sum to
+	// zero (RFC 1071's verification property).
+	if sum := checksum(pkt[:ipv4HeaderLen], 0); sum != 0 {
+		t.Errorf("IPv4 header checksum = %#04x, want 0", sum)
+	}
+}
+
+func TestBuildIPv6ParseRoundTrip(t *testing.T) {
+	src := netip.MustParseAddr("2001:db8::1")
+	dst := netip.MustParseAddr("2001:db8::2")
+	payload := []byte("hello")
+
+	pkt := buildIPv6(src, dst, protoUDP, payload)
+	got, err := parseIP(pkt)
+	if err != nil {
+		t.Fatalf("parseIP: %v", err)
+	}
+	if !got.isV6 || got.src != src || got.dst != dst || got.protocol != protoUDP {
+		t.Errorf("parsed = %+v, want isV6=true src=%v dst=%v protocol=%d", got, src, dst, protoUDP)
+	}
+	if string(got.payload) != string(payload) {
+		t.Errorf("parsed payload = %q, want %q", got.payload, payload)
+	}
+}
+
+func TestParseIPRejectsFragment(t *testing.T) {
+	src := netip.MustParseAddr("10.0.0.1")
+	dst := netip.MustParseAddr("10.0.0.2")
+	pkt := buildIPv4(src, dst, protoUDP, []byte("x"))
+	// Set the "more fragments" flag.
+	pkt[6] |= 0x20
+	if _, err := parseIP(pkt); err == nil {
+		t.Error("expected parseIP to reject a fragmented packet")
+	}
+}
+
+func TestBuildTCPParseRoundTripAndChecksum(t *testing.T) {
+	src := netip.MustParseAddr("10.0.0.1")
+	dst := netip.MustParseAddr("10.0.0.2")
+	seg := tcpSegment{
+		srcPort: 12345,
+		dstPort: 443,
+		seq:     1,
+		ack:     2,
+		flags:   tcpFlagSYN,
+		window:  65535,
+		payload: nil,
+	}
+
+	b := buildTCP(src, dst, seg, 1400)
+	got, err := parseTCP(b)
+	if err != nil {
+		t.Fatalf("parseTCP: %v", err)
+	}
+	if got.srcPort != seg.srcPort || got.dstPort != seg.dstPort || got.seq != seg.seq || got.ack != seg.ack || got.flags != seg.flags {
+		t.Errorf("parsed = %+v, want matching fields from %+v", got, seg)
+	}
+	if got.mss != 1400 {
+		t.Errorf("parsed mss = %d, want 1400", got.mss)
+	}
+
+	pseudo := pseudoHeaderSum(src, dst, protoTCP, len(b))
+	if sum := checksum(b, pseudo); sum != 0 {
+		t.Errorf("TCP checksum over full segment = %#04x, want 0", sum)
+	}
+}
+
+func TestBuildTCPNoMSSOption(t *testing.T) {
+	src := netip.MustParseAddr("10.0.0.1")
+	dst := netip.MustParseAddr("10.0.0.2")
+	seg := tcpSegment{srcPort: 1, dstPort: 2, flags: tcpFlagACK, payload: []byte("data")}
+
+	b := buildTCP(src, dst, seg, 0)
+	got, err := parseTCP(b)
+	if err != nil {
+		t.Fatalf("parseTCP: %v", err)
+	}
+	if got.mss != 0 {
+		t.Errorf("parsed mss = %d, want 0 (ACK carries no MSS option)", got.mss)
+	}
+	if string(got.payload) != "data" {
+		t.Errorf("parsed payload = %q, want %q", got.payload, "data")
+	}
+}
+
+func TestBuildUDPParseRoundTripAndChecksum(t *testing.T) {
+	src := netip.MustParseAddr("10.0.0.1")
+	dst := netip.MustParseAddr("10.0.0.2")
+	payload := []byte("dns query")
+
+	b := buildUDP(src, dst, 5000, 53, payload)
+	got, err := parseUDP(b)
+	if err != nil {
+		t.Fatalf("parseUDP: %v", err)
+	}
+	if got.srcPort != 5000 || got.dstPort != 53 || string(got.payload) != string(payload) {
+		t.Errorf("parsed = %+v, want srcPort=5000 dstPort=53 payload=%q", got, payload)
+	}
+
+	pseudo := pseudoHeaderSum(src, dst, protoUDP, len(b))
+	if sum := checksum(b, pseudo); sum != 0 {
+		t.Errorf("UDP checksum over full datagram = %#04x, want 0", sum)
+	}
+}
+
+func TestBuildUDPNeverEmitsZeroChecksum(t *testing.T) {
+	// A wire value of 0 means "checksum not computed"; buildUDP must never
+	// produce that by coincidence, substituting 0xffff instead.
+	src := netip.MustParseAddr("10.0.0.1")
+	dst := netip.MustParseAddr("10.0.0.1")
+	for port := uint16(0); port < 2000; port++ {
+		b := buildUDP(src, dst, port, port, nil)
+		if got := uint16(b[6])<<8 | uint16(b[7]); got == 0 {
+			t.Fatalf("buildUDP produced a zero checksum for port %d", port)
+		}
+	}
+}
+
+func TestParseMSSOption(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []byte
+		want uint16
+	}{
+		{"no options", nil, 0},
+		{"mss only", []byte{tcpOptMSS, 4, 0x05, 0x78}, 1400},
+		{"nop padded mss", []byte{tcpOptNOP, tcpOptNOP, tcpOptMSS, 4, 0x05, 0xb4}, 1460},
+		{"eol before mss", []byte{tcpOptEOL, tcpOptMSS, 4, 0x05, 0x78}, 0},
+		{"truncated mss", []byte{tcpOptMSS, 4, 0x05}, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := parseMSSOption(c.opts); got != c.want {
+				t.Errorf("parseMSSOption(%v) = %d, want %d", c.opts, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/network"
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// defaultMTU matches lwip2transport's packetMTU; it's the tun device's MTU
+// in every deployment of this app.
+const defaultMTU = 1500
+
+// defaultIdleTimeout is how long a flow can go without a packet in either
+// direction before it's reaped, mirroring conntrack.DefaultTCPTimeout.
+const defaultIdleTimeout = 5 * time.Minute
+
+// Config customizes a Stack. The zero Config is the usual configuration.
+type Config struct {
+	// MTU is the maximum size of a single IP packet the Stack will read or
+	// write. 0 means defaultMTU.
+	MTU int
+	// IdleTimeout is how long a flow can sit idle before it's reaped. 0
+	// means defaultIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// Stack is a [network.IPDevice] that terminates TCP and UDP itself instead
+// of delegating to lwIP: it parses every IP packet written to it, maintains
+// a flow per 5-tuple, and relays each flow's payload through a
+// [transport.StreamDialer] (TCP) or [network.PacketProxy] (UDP).
+type Stack struct {
+	sd  transport.StreamDialer
+	pp  network.PacketProxy
+	mtu int
+
+	flows *flowTable
+
+	outbound chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ network.IPDevice = (*Stack)(nil)
+
+// ConfigureDevice is gonat's counterpart to lwip2transport.ConfigureDevice:
+// it returns a [network.IPDevice] that translates the IP packets written to
+// it into TCP/UDP traffic dialed through sd and pp, and vice versa, without
+// the cgo dependency lwIP brings in. Unlike the lwIP device, a gonat Stack
+// isn't a singleton - each call returns an independent instance.
+func ConfigureDevice(sd transport.StreamDialer, pp network.PacketProxy) (network.IPDevice, error) {
+	return New(sd, pp, Config{})
+}
+
+// New is like ConfigureDevice but accepts a Config for callers that want to
+// override the MTU or flow idle timeout.
+func New(sd transport.StreamDialer, pp network.PacketProxy, cfg Config) (*Stack, error) {
+	if sd == nil || pp == nil {
+		return nil, errors.New("both sd and pp are required")
+	}
+	mtu := cfg.MTU
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	idleTimeout := cfg.IdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	s := &Stack{
+		sd:       sd,
+		pp:       pp,
+		mtu:      mtu,
+		outbound: make(chan []byte, 256),
+		closed:   make(chan struct{}),
+	}
+	s.flows = newFlowTable(s, idleTimeout)
+	return s, nil
+}
+
+// MTU implements network.IPDevice.
+func (s *Stack) MTU() int {
+	return s.mtu
+}
+
+// Close implements network.IPDevice. It tears down every live flow; it does
+// not close sd or pp themselves.
+func (s *Stack) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		s.flows.closeAll()
+	})
+	return nil
+}
+
+// Read implements network.IPDevice. It blocks until a reply IP packet - a
+// SYN-ACK, data, or a FIN/RST generated by one of this Stack's flows - is
+// ready, or the Stack is closed.
+func (s *Stack) Read(p []byte) (int, error) {
+	select {
+	case pkt := <-s.outbound:
+		return copy(p, pkt), nil
+	case <-s.closed:
+		return 0, io.EOF
+	}
+}
+
+// Write implements network.IPDevice. It parses b as a single IP packet and
+// feeds it to the matching flow, creating one for a new TCP SYN or the
+// first datagram of a UDP flow.
+func (s *Stack) Write(b []byte) (int, error) {
+	select {
+	case <-s.closed:
+		return 0, network.ErrClosed
+	default:
+	}
+	if len(b) > s.mtu {
+		return 0, network.ErrMsgSize
+	}
+
+	pkt := make([]byte, len(b))
+	copy(pkt, b)
+	if err := s.flows.handlePacket(pkt); err != nil {
+		log.Printf("[debug] gonat: dropping unparseable packet: %v\n", err)
+	}
+	return len(b), nil
+}
+
+// emit queues an IP packet built by a flow to be returned by a future Read.
+// It never blocks: if the outbound queue is full, the packet is dropped,
+// same as a real link dropping a packet under congestion - the owning
+// flow's retransmission logic is what recovers from that.
+func (s *Stack) emit(pkt []byte) {
+	select {
+	case s.outbound <- pkt:
+	case <-s.closed:
+	default:
+		log.Println("[warn] gonat: outbound queue full, dropping a packet")
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// fiveTuple identifies a flow by protocol and both endpoints. Unlike
+// conntrack.FiveTuple (which only the DoH dialer/packet proxy see, after
+// lwIP has already stripped the device-local port), gonat parses raw
+// packets itself and needs the source port to tell apart concurrent flows
+// from the same device to the same destination.
+type fiveTuple struct {
+	proto uint8
+	src   netip.AddrPort
+	dst   netip.AddrPort
+}
+
+// flowTable owns every live TCP and UDP flow, keyed by fiveTuple, and reaps
+// ones that have gone idle past idleTimeout.
+type flowTable struct {
+	stack *Stack
+
+	mu  sync.Mutex
+	tcp map[fiveTuple]*tcpFlow
+	udp map[fiveTuple]*udpFlow
+
+	idleTimeout time.Duration
+}
+
+func newFlowTable(s *Stack, idleTimeout time.Duration) *flowTable {
+	t := &flowTable{
+		stack:       s,
+		tcp:         make(map[fiveTuple]*tcpFlow),
+		udp:         make(map[fiveTuple]*udpFlow),
+		idleTimeout: idleTimeout,
+	}
+	go t.reapLoop()
+	return t
+}
+
+// handlePacket dispatches a single IP packet read from the tun device to
+// the TCP or UDP flow it belongs to, creating one if this is the start of a
+// new TCP connection or the first datagram of a new UDP flow.
+func (t *flowTable) handlePacket(pkt []byte) error {
+	ip, err := parseIP(pkt)
+	if err != nil {
+		return err
+	}
+	switch ip.protocol {
+	case protoTCP:
+		return t.handleTCP(ip)
+	case protoUDP:
+		return t.handleUDP(ip)
+	default:
+		return fmt.Errorf("unsupported IP protocol %d", ip.protocol)
+	}
+}
+
+func (t *flowTable) handleTCP(ip ipPacket) error {
+	seg, err := parseTCP(ip.payload)
+	if err != nil {
+		return err
+	}
+	key := fiveTuple{
+		proto: protoTCP,
+		src:   netip.AddrPortFrom(ip.src, seg.srcPort),
+		dst:   netip.AddrPortFrom(ip.dst, seg.dstPort),
+	}
+
+	t.mu.Lock()
+	flow, ok := t.tcp[key]
+	if !ok {
+		if seg.flags&tcpFlagSYN == 0 {
+			t.mu.Unlock()
+			t.sendTCPReset(ip, seg)
+			return nil
+		}
+		flow = newTCPFlow(t, key, ip.isV6)
+		t.tcp[key] = flow
+	}
+	t.mu.Unlock()
+
+	flow.handleSegment(seg)
+	return nil
+}
+
+// sendTCPReset answers a non-SYN segment that doesn't belong to any flow we
+// know about (most commonly a retransmission that arrived after we already
+// reaped the flow) the way a real TCP stack would: with a RST.
+func (t *flowTable) sendTCPReset(ip ipPacket, seg tcpSegment) {
+	if seg.flags&tcpFlagRST != 0 {
+		return
+	}
+	reply := tcpSegment{
+		srcPort: seg.dstPort,
+		dstPort: seg.srcPort,
+		seq:     seg.ack,
+		flags:   tcpFlagRST | tcpFlagACK,
+	}
+	reply.ack = seg.seq + uint32(len(seg.payload))
+	if seg.flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		reply.ack++
+	}
+	t.stack.emit(buildIP(ip.isV6, ip.dst, ip.src, protoTCP, buildTCP(ip.dst, ip.src, reply, 0)))
+}
+
+func (t *flowTable) handleUDP(ip ipPacket) error {
+	dgram, err := parseUDP(ip.payload)
+	if err != nil {
+		return err
+	}
+	key := fiveTuple{
+		proto: protoUDP,
+		src:   netip.AddrPortFrom(ip.src, dgram.srcPort),
+		dst:   netip.AddrPortFrom(ip.dst, dgram.dstPort),
+	}
+
+	t.mu.Lock()
+	flow, ok := t.udp[key]
+	if !ok {
+		var err error
+		flow, err = newUDPFlow(t, key, ip.isV6)
+		if err != nil {
+			t.mu.Unlock()
+			return err
+		}
+		t.udp[key] = flow
+	}
+	t.mu.Unlock()
+
+	flow.writeTo(dgram.payload)
+	return nil
+}
+
+func (t *flowTable) removeTCP(key fiveTuple) {
+	t.mu.Lock()
+	delete(t.tcp, key)
+	t.mu.Unlock()
+}
+
+func (t *flowTable) removeUDP(key fiveTuple) {
+	t.mu.Lock()
+	delete(t.udp, key)
+	t.mu.Unlock()
+}
+
+func (t *flowTable) reapLoop() {
+	ticker := time.NewTicker(t.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.reapIdle()
+		case <-t.stack.closed:
+			return
+		}
+	}
+}
+
+func (t *flowTable) reapIdle() {
+	now := time.Now()
+
+	var dead []*tcpFlow
+	t.mu.Lock()
+	for k, f := range t.tcp {
+		if now.Sub(f.lastActivity()) > t.idleTimeout {
+			delete(t.tcp, k)
+			dead = append(dead, f)
+		}
+	}
+	var deadUDP []*udpFlow
+	for k, f := range t.udp {
+		if now.Sub(f.lastActivity()) > t.idleTimeout {
+			delete(t.udp, k)
+			deadUDP = append(deadUDP, f)
+		}
+	}
+	t.mu.Unlock()
+
+	for _, f := range dead {
+		f.close()
+	}
+	for _, f := range deadUDP {
+		f.close()
+	}
+}
+
+// closeAll tears down every live flow. Called once, when the Stack itself
+// is closed.
+func (t *flowTable) closeAll() {
+	t.mu.Lock()
+	tcpFlows := t.tcp
+	udpFlows := t.udp
+	t.tcp = make(map[fiveTuple]*tcpFlow)
+	t.udp = make(map[fiveTuple]*udpFlow)
+	t.mu.Unlock()
+
+	for _, f := range tcpFlows {
+		f.close()
+	}
+	for _, f := range udpFlows {
+		f.close()
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+const (
+	tcpHeaderLen = 20
+
+	tcpFlagFIN = 1 << 0
+	tcpFlagSYN = 1 << 1
+	tcpFlagRST = 1 << 2
+	tcpFlagPSH = 1 << 3
+	tcpFlagACK = 1 << 4
+
+	tcpOptMSS = 2
+	tcpOptEOL = 0
+	tcpOptNOP = 1
+)
+
+// tcpSegment is a parsed TCP header (options dropped after MSS is read) plus
+// its payload.
+type tcpSegment struct {
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	ack     uint32
+	flags   uint8
+	window  uint16
+	mss     uint16 // 0 if the SYN carried none
+	payload []byte
+}
+
+func parseTCP(b []byte) (tcpSegment, error) {
+	if len(b) < tcpHeaderLen {
+		return tcpSegment{}, errors.New("tcp segment shorter than a header")
+	}
+	dataOffset := int(b[12]>>4) * 4
+	if dataOffset < tcpHeaderLen || dataOffset > len(b) {
+		return tcpSegment{}, errors.New("invalid tcp data offset")
+	}
+	seg := tcpSegment{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		seq:     binary.BigEndian.Uint32(b[4:8]),
+		ack:     binary.BigEndian.Uint32(b[8:12]),
+		flags:   b[13],
+		window:  binary.BigEndian.Uint16(b[14:16]),
+		payload: b[dataOffset:],
+	}
+	if seg.flags&tcpFlagSYN != 0 {
+		seg.mss = parseMSSOption(b[tcpHeaderLen:dataOffset])
+	}
+	return seg, nil
+}
+
+// parseMSSOption scans TCP options looking for an MSS option (kind 2),
+// returning 0 if none is present or the options are malformed.
+func parseMSSOption(opts []byte) uint16 {
+	for i := 0; i < len(opts); {
+		switch opts[i] {
+		case tcpOptEOL:
+			return 0
+		case tcpOptNOP:
+			i++
+		case tcpOptMSS:
+			if i+4 > len(opts) {
+				return 0
+			}
+			return binary.BigEndian.Uint16(opts[i+2 : i+4])
+		default:
+			if i+1 >= len(opts) || opts[i+1] < 2 {
+				return 0
+			}
+			i += int(opts[i+1])
+		}
+	}
+	return 0
+}
+
+// buildTCP packs seg into wire format, including an MSS option when mss is
+// non-zero (only meaningful alongside the SYN flag), and fills in the
+// checksum against src/dst.
+func buildTCP(src, dst netip.Addr, seg tcpSegment, mss uint16) []byte {
+	var opts []byte
+	if mss != 0 {
+		opts = []byte{tcpOptMSS, 4, byte(mss >> 8), byte(mss)}
+	}
+	dataOffset := tcpHeaderLen + len(opts)
+	b := make([]byte, dataOffset+len(seg.payload))
+	binary.BigEndian.PutUint16(b[0:2], seg.srcPort)
+	binary.BigEndian.PutUint16(b[2:4], seg.dstPort)
+	binary.BigEndian.PutUint32(b[4:8], seg.seq)
+	binary.BigEndian.PutUint32(b[8:12], seg.ack)
+	b[12] = byte(dataOffset/4) << 4
+	b[13] = seg.flags
+	binary.BigEndian.PutUint16(b[14:16], seg.window)
+	copy(b[tcpHeaderLen:dataOffset], opts)
+	copy(b[dataOffset:], seg.payload)
+
+	pseudo := pseudoHeaderSum(src, dst, protoTCP, len(b))
+	binary.BigEndian.PutUint16(b[16:18], checksum(b, pseudo))
+	return b
+}
@@ -0,0 +1,492 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+const (
+	tcpStateSynRcvd = iota
+	tcpStateEstablished
+	tcpStateClosed
+)
+
+// recvWindow is the receive window this stack advertises to the client.
+// There's no window-scaling option, so this is capped at 65535, same as a
+// pre-RFC1323 TCP stack.
+const recvWindow = 65535
+
+// retransmitInterval and maxRetransmits bound how long a flow keeps
+// resending an unacked segment (SYN-ACK, data, or FIN) before giving up and
+// resetting the connection. This stack only ever has one segment in flight
+// per direction (see tcpDownlink), so a fixed interval is enough - there's
+// no congestion window to estimate an RTT for.
+const (
+	retransmitInterval = 1 * time.Second
+	maxRetransmits     = 8
+)
+
+// tcpFlow terminates one TCP connection from the tun device and relays its
+// payload through a transport.StreamConn dialed from the flow's
+// destination. It keeps at most one unacked segment per direction
+// (stop-and-wait, not a sliding window) - simpler than a real TCP stack,
+// and slower on high-bandwidth-delay-product paths, but correct, and this
+// is local loopback-to-process traffic rather than a long-haul link.
+type tcpFlow struct {
+	table *flowTable
+	key   fiveTuple
+	isV6  bool
+
+	mss uint16 // clamped to this Stack's MTU, advertised in our SYN-ACK
+
+	lastActive atomic.Int64 // unix nanos
+
+	mu      sync.Mutex
+	state   int
+	rcvNext uint32 // next client sequence number we expect
+	sndNext uint32 // next sequence number we will use
+	sndUna  uint32 // oldest byte we've sent that isn't acked yet
+
+	pendingPayload []byte // unacked outbound bytes (SYN/FIN carry no payload)
+	pendingFlags   uint8
+	pendingSeq     uint32
+	timerGen       int
+	timer          *time.Timer
+	retries        int
+
+	doneReading bool // client sent FIN
+	doneWriting bool // our downlink pump saw EOF and sent our FIN
+
+	pendingIn []byte // client bytes received before conn was ready to take them
+
+	conn          transport.StreamConn
+	connReady     chan struct{}
+	connReadyOnce sync.Once
+
+	closeOnce sync.Once
+}
+
+func newTCPFlow(t *flowTable, key fiveTuple, isV6 bool) *tcpFlow {
+	f := &tcpFlow{
+		table:     t,
+		key:       key,
+		isV6:      isV6,
+		connReady: make(chan struct{}),
+	}
+	f.lastActive.Store(time.Now().UnixNano())
+	return f
+}
+
+func (f *tcpFlow) lastActivity() time.Time {
+	return time.Unix(0, f.lastActive.Load())
+}
+
+func (f *tcpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+// handleSegment processes one TCP segment from the client. It's always
+// called from the Stack's single Write-driven goroutine, so handleSegment
+// calls for this flow never overlap.
+func (f *tcpFlow) handleSegment(seg tcpSegment) {
+	f.touch()
+
+	if seg.flags&tcpFlagRST != 0 {
+		f.close()
+		return
+	}
+
+	f.mu.Lock()
+	switch f.state {
+	case tcpStateSynRcvd:
+		f.handleHandshakeAck(seg)
+		f.mu.Unlock()
+	case tcpStateEstablished:
+		f.mu.Unlock()
+		f.handleEstablished(seg)
+	default:
+		f.mu.Unlock()
+	}
+}
+
+// handleHandshakeAck must be called with f.mu held. On the SYN that created
+// this flow, it starts dialing out; on the client's ACK completing the
+// handshake, it moves to established and starts the downlink pump.
+func (f *tcpFlow) handleHandshakeAck(seg tcpSegment) {
+	if seg.flags&tcpFlagSYN != 0 && f.conn == nil && f.sndNext == 0 {
+		f.rcvNext = seg.seq + 1
+		f.mss = clampMSS(seg.mss, f.table.stack.mtu)
+
+		var isnBuf [4]byte
+		_, _ = rand.Read(isnBuf[:])
+		iss := binary.BigEndian.Uint32(isnBuf[:])
+		f.sndNext = iss
+		f.sndUna = iss
+
+		f.sendTrackedLocked(tcpFlagSYN, nil)
+		go f.dial()
+		return
+	}
+	if seg.flags&tcpFlagACK != 0 && seg.ack == f.sndUna+1 {
+		f.sndUna++
+		f.clearPendingLocked()
+		f.state = tcpStateEstablished
+		go f.runDownlink()
+	}
+}
+
+// clampMSS returns the smaller of the client's advertised MSS (0 if it sent
+// none, treated as the default 536) and what fits in this Stack's MTU.
+func clampMSS(clientMSS uint16, mtu int) uint16 {
+	if clientMSS == 0 {
+		clientMSS = 536
+	}
+	max := uint16(mtu - ipv4HeaderLen - tcpHeaderLen)
+	if clientMSS > max {
+		return max
+	}
+	return clientMSS
+}
+
+func (f *tcpFlow) handleEstablished(seg tcpSegment) {
+	f.mu.Lock()
+	ackRcvNext := false
+
+	if len(seg.payload) > 0 && seg.seq == f.rcvNext {
+		f.rcvNext += uint32(len(seg.payload))
+		ackRcvNext = true
+		conn := f.conn
+		if conn == nil {
+			f.pendingIn = append(f.pendingIn, seg.payload...)
+			f.mu.Unlock()
+		} else {
+			f.mu.Unlock()
+			if _, err := conn.Write(seg.payload); err != nil {
+				f.abort()
+				return
+			}
+		}
+		f.mu.Lock()
+	}
+
+	if seg.flags&tcpFlagFIN != 0 && seg.seq+uint32(len(seg.payload)) == f.rcvNext && !f.doneReading {
+		f.rcvNext++
+		f.doneReading = true
+		ackRcvNext = true
+		conn := f.conn
+		f.mu.Unlock()
+		if conn != nil {
+			_ = conn.CloseWrite()
+		}
+		f.mu.Lock()
+	}
+
+	if seg.flags&tcpFlagACK != 0 {
+		f.handleAckLocked(seg.ack)
+	}
+
+	rcvNext := f.rcvNext
+	sndNext := f.sndNext
+	fullyClosed := f.doneReading && f.doneWriting && f.sndUna == f.sndNext
+	f.mu.Unlock()
+
+	if ackRcvNext {
+		f.sendAck(rcvNext, sndNext)
+	}
+	if fullyClosed {
+		f.close()
+	}
+}
+
+// handleAckLocked must be called with f.mu held. It advances sndUna when
+// the client acks our one outstanding segment.
+func (f *tcpFlow) handleAckLocked(ack uint32) {
+	if f.pendingPayload == nil && f.pendingFlags == 0 {
+		return
+	}
+	consumed := uint32(len(f.pendingPayload))
+	if f.pendingFlags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		consumed++
+	}
+	if ack == f.pendingSeq+consumed {
+		f.sndUna = ack
+		f.clearPendingLocked()
+	}
+}
+
+// sendTrackedLocked must be called with f.mu held. It sends payload/flags
+// as the next segment, and arms the retransmit timer until the client acks
+// it.
+func (f *tcpFlow) sendTrackedLocked(flags uint8, payload []byte) {
+	f.pendingPayload = payload
+	f.pendingFlags = flags
+	f.pendingSeq = f.sndNext
+
+	consumed := uint32(len(payload))
+	if flags&(tcpFlagSYN|tcpFlagFIN) != 0 {
+		consumed++
+	}
+	f.sndNext += consumed
+
+	f.transmitLocked(flags, f.pendingSeq, payload)
+	f.armRetransmitLocked()
+}
+
+func (f *tcpFlow) armRetransmitLocked() {
+	f.timerGen++
+	gen := f.timerGen
+	f.retries = 0
+	if f.timer != nil {
+		f.timer.Stop()
+	}
+	f.timer = time.AfterFunc(retransmitInterval, func() { f.onRetransmitTimer(gen) })
+}
+
+func (f *tcpFlow) clearPendingLocked() {
+	f.pendingPayload = nil
+	f.pendingFlags = 0
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+	}
+}
+
+func (f *tcpFlow) onRetransmitTimer(gen int) {
+	f.mu.Lock()
+	if gen != f.timerGen || (f.pendingPayload == nil && f.pendingFlags == 0) {
+		f.mu.Unlock()
+		return
+	}
+	if f.retries >= maxRetransmits {
+		f.mu.Unlock()
+		f.abort()
+		return
+	}
+	f.retries++
+	flags, seq, payload := f.pendingFlags, f.pendingSeq, f.pendingPayload
+	f.timer.Reset(retransmitInterval)
+	f.transmitLocked(flags, seq, payload)
+	f.mu.Unlock()
+}
+
+// transmitLocked must be called with f.mu held. It builds and emits one
+// segment, acking through f.rcvNext.
+func (f *tcpFlow) transmitLocked(flags uint8, seq uint32, payload []byte) {
+	mss := uint16(0)
+	if flags&tcpFlagSYN != 0 {
+		mss = f.mss
+	}
+	seg := tcpSegment{
+		srcPort: f.key.dst.Port(),
+		dstPort: f.key.src.Port(),
+		seq:     seq,
+		ack:     f.rcvNext,
+		flags:   flags | tcpFlagACK,
+		window:  recvWindow,
+		payload: payload,
+	}
+	pkt := buildIP(f.isV6, f.key.dst.Addr(), f.key.src.Addr(), protoTCP, buildTCP(f.key.dst.Addr(), f.key.src.Addr(), seg, mss))
+	f.table.stack.emit(pkt)
+}
+
+// sendAck sends a bare ACK (no new data) acking up through rcvNext, sent as
+// of sequence number sndNext.
+func (f *tcpFlow) sendAck(rcvNext, sndNext uint32) {
+	seg := tcpSegment{
+		srcPort: f.key.dst.Port(),
+		dstPort: f.key.src.Port(),
+		seq:     sndNext,
+		ack:     rcvNext,
+		flags:   tcpFlagACK,
+		window:  recvWindow,
+	}
+	pkt := buildIP(f.isV6, f.key.dst.Addr(), f.key.src.Addr(), protoTCP, buildTCP(f.key.dst.Addr(), f.key.src.Addr(), seg, 0))
+	f.table.stack.emit(pkt)
+}
+
+// dial connects out to the flow's destination and, once done, flushes any
+// client bytes that arrived before the connection was ready and wakes
+// runDownlink.
+func (f *tcpFlow) dial() {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := f.table.stack.sd.Dial(ctx, f.key.dst.String())
+	if err != nil {
+		log.Printf("[warn] gonat: dial %v failed: %v\n", f.key.dst, err)
+		f.abort()
+		return
+	}
+
+	f.mu.Lock()
+	if f.state == tcpStateClosed {
+		f.mu.Unlock()
+		conn.Close()
+		return
+	}
+	f.conn = conn
+	pending := f.pendingIn
+	f.pendingIn = nil
+	f.mu.Unlock()
+
+	if len(pending) > 0 {
+		if _, err := conn.Write(pending); err != nil {
+			f.abort()
+			return
+		}
+	}
+	f.signalConnReady()
+}
+
+// signalConnReady unblocks runDownlink, whether because a conn is ready or
+// because the flow was aborted/closed before dial ever finished.
+func (f *tcpFlow) signalConnReady() {
+	f.connReadyOnce.Do(func() { close(f.connReady) })
+}
+
+// runDownlink pumps conn's output back to the client, one stop-and-wait
+// segment at a time, until conn is exhausted or the flow is aborted.
+func (f *tcpFlow) runDownlink() {
+	<-f.connReady
+	f.mu.Lock()
+	conn := f.conn
+	mss := f.mss
+	f.mu.Unlock()
+	if conn == nil {
+		return
+	}
+
+	buf := make([]byte, mss)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			chunk := make([]byte, n)
+			copy(chunk, buf[:n])
+			if !f.sendChunkAndWait(chunk) {
+				return
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[debug] gonat: downlink read from %v ended: %v\n", f.key.dst, err)
+			}
+			f.sendFinAndWait()
+			return
+		}
+	}
+}
+
+// sendChunkAndWait sends chunk as the next outbound segment and blocks
+// until it's acked (or the flow gives up retransmitting it and aborts).
+// It returns false if the flow is no longer usable.
+func (f *tcpFlow) sendChunkAndWait(chunk []byte) bool {
+	f.mu.Lock()
+	if f.state == tcpStateClosed {
+		f.mu.Unlock()
+		return false
+	}
+	f.sendTrackedLocked(0, chunk)
+	f.mu.Unlock()
+	return f.waitForAck()
+}
+
+func (f *tcpFlow) sendFinAndWait() {
+	f.mu.Lock()
+	if f.state == tcpStateClosed {
+		f.mu.Unlock()
+		return
+	}
+	f.sendTrackedLocked(tcpFlagFIN, nil)
+	f.mu.Unlock()
+	if f.waitForAck() {
+		f.mu.Lock()
+		f.doneWriting = true
+		fullyClosed := f.doneReading
+		f.mu.Unlock()
+		if fullyClosed {
+			f.close()
+		}
+	}
+}
+
+// waitForAck polls for the pending segment to be cleared (acked) or the
+// flow to close. It's a simple poll rather than a condition variable
+// because it only needs to notice on the order of retransmitInterval, not
+// immediately.
+func (f *tcpFlow) waitForAck() bool {
+	const pollInterval = 20 * time.Millisecond
+	for {
+		f.mu.Lock()
+		state := f.state
+		pending := f.pendingPayload != nil || f.pendingFlags != 0
+		f.mu.Unlock()
+		if state == tcpStateClosed {
+			return false
+		}
+		if !pending {
+			return true
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// abort tears the flow down with a RST to the client, for errors (a failed
+// dial, a write to conn failing, exhausted retransmits) rather than a clean
+// close.
+func (f *tcpFlow) abort() {
+	f.mu.Lock()
+	if f.state != tcpStateClosed {
+		seg := tcpSegment{
+			srcPort: f.key.dst.Port(),
+			dstPort: f.key.src.Port(),
+			seq:     f.sndNext,
+			ack:     f.rcvNext,
+			flags:   tcpFlagRST | tcpFlagACK,
+		}
+		pkt := buildIP(f.isV6, f.key.dst.Addr(), f.key.src.Addr(), protoTCP, buildTCP(f.key.dst.Addr(), f.key.src.Addr(), seg, 0))
+		f.table.stack.emit(pkt)
+	}
+	f.mu.Unlock()
+	f.close()
+}
+
+// close tears the flow down without notifying the client, for when the
+// client itself already sent a RST or this flow is being reaped.
+func (f *tcpFlow) close() {
+	f.closeOnce.Do(func() {
+		f.mu.Lock()
+		f.state = tcpStateClosed
+		if f.timer != nil {
+			f.timer.Stop()
+		}
+		conn := f.conn
+		f.mu.Unlock()
+
+		f.signalConnReady()
+		f.table.removeTCP(f.key)
+		if conn != nil {
+			conn.Close()
+		}
+	})
+}
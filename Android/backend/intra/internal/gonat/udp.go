@@ -0,0 +1,63 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import (
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+const udpHeaderLen = 8
+
+type udpDatagram struct {
+	srcPort uint16
+	dstPort uint16
+	payload []byte
+}
+
+func parseUDP(b []byte) (udpDatagram, error) {
+	if len(b) < udpHeaderLen {
+		return udpDatagram{}, errors.New("udp datagram shorter than a header")
+	}
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if length < udpHeaderLen || length > len(b) {
+		length = len(b)
+	}
+	return udpDatagram{
+		srcPort: binary.BigEndian.Uint16(b[0:2]),
+		dstPort: binary.BigEndian.Uint16(b[2:4]),
+		payload: b[udpHeaderLen:length],
+	}, nil
+}
+
+// buildUDP packs a datagram from src:srcPort to dst:dstPort in wire format,
+// including the checksum.
+func buildUDP(src, dst netip.Addr, srcPort, dstPort uint16, payload []byte) []byte {
+	length := udpHeaderLen + len(payload)
+	b := make([]byte, length)
+	binary.BigEndian.PutUint16(b[0:2], srcPort)
+	binary.BigEndian.PutUint16(b[2:4], dstPort)
+	binary.BigEndian.PutUint16(b[4:6], uint16(length))
+	copy(b[udpHeaderLen:], payload)
+
+	pseudo := pseudoHeaderSum(src, dst, protoUDP, length)
+	sum := checksum(b, pseudo)
+	if sum == 0 {
+		sum = 0xffff // a zero UDP checksum means "no checksum"; avoid producing one
+	}
+	binary.BigEndian.PutUint16(b[6:8], sum)
+	return b
+}
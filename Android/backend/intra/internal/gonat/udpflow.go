@@ -0,0 +1,112 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gonat
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-sdk/network"
+)
+
+// udpFlow relays one UDP 5-tuple's datagrams through a
+// network.PacketRequestSender/PacketResponseReceiver pair obtained from the
+// Stack's PacketProxy, translating responses back into IP/UDP packets
+// addressed to the client.
+type udpFlow struct {
+	table *flowTable
+	key   fiveTuple
+	isV6  bool
+
+	lastActive atomic.Int64 // unix nanos
+
+	mu     sync.Mutex
+	sender network.PacketRequestSender
+	closed bool
+}
+
+var _ network.PacketResponseReceiver = (*udpFlow)(nil)
+
+func newUDPFlow(t *flowTable, key fiveTuple, isV6 bool) (*udpFlow, error) {
+	f := &udpFlow{table: t, key: key, isV6: isV6}
+	f.lastActive.Store(time.Now().UnixNano())
+
+	sender, err := t.stack.pp.NewSession(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create UDP session for %v: %w", key.dst, err)
+	}
+	f.sender = sender
+	return f, nil
+}
+
+func (f *udpFlow) lastActivity() time.Time {
+	return time.Unix(0, f.lastActive.Load())
+}
+
+func (f *udpFlow) touch() {
+	f.lastActive.Store(time.Now().UnixNano())
+}
+
+// writeTo sends one client datagram out through the PacketProxy.
+func (f *udpFlow) writeTo(payload []byte) {
+	f.touch()
+	f.mu.Lock()
+	sender := f.sender
+	f.mu.Unlock()
+	if sender == nil {
+		return
+	}
+	if _, err := sender.WriteTo(payload, f.key.dst); err != nil {
+		f.close()
+	}
+}
+
+// WriteFrom implements network.PacketResponseReceiver: it's called by the
+// PacketProxy with a response datagram, which this wraps in an IP/UDP
+// packet addressed back to the client and hands to the Stack to emit.
+func (f *udpFlow) WriteFrom(p []byte, source net.Addr) (int, error) {
+	f.touch()
+	pkt := buildIP(f.isV6, f.key.dst.Addr(), f.key.src.Addr(), protoUDP,
+		buildUDP(f.key.dst.Addr(), f.key.src.Addr(), f.key.dst.Port(), f.key.src.Port(), p))
+	f.table.stack.emit(pkt)
+	return len(p), nil
+}
+
+// Close implements network.PacketResponseReceiver. It's called by the
+// PacketProxy when it's done with this session; close removes the flow
+// from the table too. Calling it again is a no-op.
+func (f *udpFlow) Close() error {
+	f.close()
+	return nil
+}
+
+func (f *udpFlow) close() {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return
+	}
+	f.closed = true
+	sender := f.sender
+	f.mu.Unlock()
+
+	f.table.removeUDP(f.key)
+	if sender != nil {
+		sender.Close()
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics aggregates traffic and latency counters across every TCP
+// session dohConnAdapter handles, the way conntrack aggregates per-flow
+// state: instead of each session reporting only once, to its own
+// TCPListener callback, on close, a Registry keeps running totals so an
+// app-side UI (or a developer running the backend outside Android) can read
+// live numbers without polling every session close.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBoundsMs are the histogram bucket upper bounds, in milliseconds,
+// shared by every latency metric this package records.
+var latencyBoundsMs = [numLatencyBuckets]int64{10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+const numLatencyBuckets = 10
+
+// histogram is a fixed-bucket, Prometheus-style latency histogram: each
+// bucket counts observations <= its upper bound, alongside a running sum
+// and total count for computing an average.
+type histogram struct {
+	counts [numLatencyBuckets]atomic.Int64
+	sum    atomic.Int64 // milliseconds
+	count  atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	ms := d.Milliseconds()
+	for i, bound := range latencyBoundsMs {
+		if ms <= bound {
+			h.counts[i].Add(1)
+		}
+	}
+	h.sum.Add(ms)
+	h.count.Add(1)
+}
+
+// HistogramSnapshot is a point-in-time copy of a histogram's state.
+type HistogramSnapshot struct {
+	Buckets map[int64]int64 // bucket upper bound (ms) -> cumulative count
+	Sum     int64           // total observed milliseconds
+	Count   int64
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{Buckets: make(map[int64]int64, len(latencyBoundsMs)), Sum: h.sum.Load(), Count: h.count.Load()}
+	for i, bound := range latencyBoundsMs {
+		s.Buckets[bound] = h.counts[i].Load()
+	}
+	return s
+}
+
+// Registry accumulates counters and latency histograms across every
+// connection a single IntraDevice handles. The zero Registry is not usable;
+// construct one with New.
+type Registry struct {
+	sessions      atomic.Int64
+	retries       atomic.Int64
+	retryTimeouts atomic.Int64
+	fragmented    atomic.Int64
+	uploadBytes   atomic.Int64
+	downloadBytes atomic.Int64
+
+	dialRTT   histogram
+	firstByte histogram
+
+	sniMu  sync.Mutex
+	sniHit map[string]int64
+}
+
+// New returns an empty Registry.
+func New() *Registry {
+	return &Registry{sniHit: make(map[string]int64)}
+}
+
+// RecordSession accounts for one TCP session's final byte counts, once a
+// dohConnAdapter has fully closed.
+func (r *Registry) RecordSession(uploadBytes, downloadBytes int64) {
+	r.sessions.Add(1)
+	r.uploadBytes.Add(uploadBytes)
+	r.downloadBytes.Add(downloadBytes)
+}
+
+// RecordRetry accounts for one split-retry attempt. timeout reports whether
+// the retry was triggered by a read timeout, as opposed to a connection
+// reset.
+func (r *Registry) RecordRetry(timeout bool) {
+	r.retries.Add(1)
+	if timeout {
+		r.retryTimeouts.Add(1)
+	}
+}
+
+// RecordFragmented accounts for one retry whose ClientHello was split at
+// the TLS record layer (as opposed to a plain TCP-segment split).
+func (r *Registry) RecordFragmented() {
+	r.fragmented.Add(1)
+}
+
+// RecordDialRTT observes one successful TCP handshake's RTT, i.e. the delay
+// between the SYN and the SYNACK.
+func (r *Registry) RecordDialRTT(d time.Duration) {
+	r.dialRTT.observe(d)
+}
+
+// RecordFirstByte observes the delay between a session's start (when its
+// dialed connection is wrapped) and its first downloaded byte.
+func (r *Registry) RecordFirstByte(d time.Duration) {
+	r.firstByte.observe(d)
+}
+
+// RecordSNI counts one more session observed with the given TLS SNI.
+func (r *Registry) RecordSNI(sni string) {
+	if sni == "" {
+		return
+	}
+	r.sniMu.Lock()
+	r.sniHit[sni]++
+	r.sniMu.Unlock()
+}
+
+// Snapshot is a serializable, point-in-time copy of a Registry's counters,
+// e.g. for an app-side UI to poll and render as live throughput.
+type Snapshot struct {
+	Sessions      int64
+	Retries       int64
+	RetryTimeouts int64
+	Fragmented    int64
+	UploadBytes   int64
+	DownloadBytes int64
+	DialRTT       HistogramSnapshot
+	FirstByte     HistogramSnapshot
+	SNI           map[string]int64
+}
+
+// Snapshot returns a copy of the Registry's current state.
+func (r *Registry) Snapshot() Snapshot {
+	r.sniMu.Lock()
+	sni := make(map[string]int64, len(r.sniHit))
+	for k, v := range r.sniHit {
+		sni[k] = v
+	}
+	r.sniMu.Unlock()
+
+	return Snapshot{
+		Sessions:      r.sessions.Load(),
+		Retries:       r.retries.Load(),
+		RetryTimeouts: r.retryTimeouts.Load(),
+		Fragmented:    r.fragmented.Load(),
+		UploadBytes:   r.uploadBytes.Load(),
+		DownloadBytes: r.downloadBytes.Load(),
+		DialRTT:       r.dialRTT.snapshot(),
+		FirstByte:     r.firstByte.snapshot(),
+		SNI:           sni,
+	}
+}
+
+// Expose writes the Registry's current state to w in Prometheus text
+// exposition format, for a developer running the backend outside Android
+// (e.g. under `go run` against a local tunnel) to scrape with `curl` or a
+// local Prometheus instance.
+func (r *Registry) Expose(w io.Writer) error {
+	s := r.Snapshot()
+
+	counters := []struct {
+		name  string
+		value int64
+	}{
+		{"intra_sessions_total", s.Sessions},
+		{"intra_retries_total", s.Retries},
+		{"intra_retry_timeouts_total", s.RetryTimeouts},
+		{"intra_retries_fragmented_total", s.Fragmented},
+		{"intra_upload_bytes_total", s.UploadBytes},
+		{"intra_download_bytes_total", s.DownloadBytes},
+	}
+	for _, c := range counters {
+		if _, err := fmt.Fprintf(w, "%s %d\n", c.name, c.value); err != nil {
+			return err
+		}
+	}
+
+	if err := exposeHistogram(w, "intra_dial_rtt_milliseconds", s.DialRTT); err != nil {
+		return err
+	}
+	if err := exposeHistogram(w, "intra_first_byte_milliseconds", s.FirstByte); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(s.SNI))
+	for name := range s.SNI {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "intra_sni_sessions_total{sni=%q} %d\n", name, s.SNI[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func exposeHistogram(w io.Writer, name string, h HistogramSnapshot) error {
+	if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+		return err
+	}
+	for _, bound := range latencyBoundsMs {
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, fmt.Sprintf("%d", bound), h.Buckets[bound]); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "%s_sum %d\n", name, h.Sum); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+	return err
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// domainCache remembers which domain name a DoH answer resolved each IP
+// address to, so MatchDestination can apply domain-based rules to a TCP
+// dial even though it only sees an IP. It's bounded by entry count rather
+// than by the answer's TTL: once full, the oldest recorded address is
+// evicted to make room, on the assumption that whatever's dialing through
+// Router is talking to a bounded set of actively-used destinations.
+type domainCache struct {
+	mu    sync.Mutex
+	limit int
+	order []netip.Addr
+	byIP  map[netip.Addr]string
+}
+
+func newDomainCache(limit int) *domainCache {
+	return &domainCache{limit: limit, byIP: make(map[netip.Addr]string)}
+}
+
+func (c *domainCache) record(domain string, addrs []netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if _, exists := c.byIP[addr]; !exists {
+			if len(c.order) >= c.limit {
+				oldest := c.order[0]
+				c.order = c.order[1:]
+				delete(c.byIP, oldest)
+			}
+			c.order = append(c.order, addr)
+		}
+		c.byIP[addr] = domain
+	}
+}
+
+func (c *domainCache) lookup(addr netip.Addr) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	domain, ok := c.byIP[addr.Unmap()]
+	return domain, ok
+}
@@ -0,0 +1,36 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"errors"
+	"net/netip"
+)
+
+// GeoIPResolver maps an IP address to its ISO 3166-1 alpha-2 country code,
+// backing the GEOIP rule kind.
+type GeoIPResolver interface {
+	Country(addr netip.Addr) (string, error)
+}
+
+// LoadGeoIPDatabase is meant to lazily load an MMDB (GeoIP2/GeoLite2)
+// database from path and return a GeoIPResolver backed by it. This tree
+// doesn't vendor an MMDB reader (e.g. github.com/oschwald/maxminddb-golang)
+// yet, so rather than silently making GEOIP rules never match, it reports
+// that error directly; once that dependency is added, this should parse
+// path and return a resolver over it.
+func LoadGeoIPDatabase(path string) (GeoIPResolver, error) {
+	return nil, errors.New("router: GEOIP rules require vendoring an MMDB reader, which this build doesn't have yet")
+}
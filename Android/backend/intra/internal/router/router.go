@@ -0,0 +1,279 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package router implements Clash-style, rule-based selection of a DoH
+// outbound (a DoH transport plus a port-443 split strategy) per
+// connection, so a device can be configured with several DoHServers and
+// dial strategies instead of exactly one of each. See doh.Router for how
+// a Router is wired into the dial path.
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/doh"
+)
+
+// Kind identifies a Rule's matching strategy, using the same names Clash
+// does for the same concept.
+type Kind string
+
+const (
+	KindDomain        Kind = "DOMAIN"
+	KindDomainSuffix  Kind = "DOMAIN-SUFFIX"
+	KindDomainKeyword Kind = "DOMAIN-KEYWORD"
+	KindIPCIDR        Kind = "IP-CIDR"
+	KindGeoIP         Kind = "GEOIP"
+	KindDstPort       Kind = "DST-PORT"
+	KindMatch         Kind = "MATCH"
+)
+
+// Split mode names accepted by AddOutbound. They mirror the internal/config
+// transport config strings applied to port-443 destinations (see
+// doh.DefaultTransportConfig), just under names an app's config UI can
+// present without exposing config's pipe-delimited syntax.
+const (
+	SplitNone   = "none"
+	SplitAlways = "always"
+	SplitRetry  = "retry"
+	SplitRandom = "random"
+)
+
+// Outbound is a named destination a Rule can route a connection to: DoH
+// answers the fake-DNS query, and TransportConfig (an internal/config
+// config string) dials port-443 destinations.
+type Outbound struct {
+	DoH             doh.DoHTransport
+	TransportConfig string
+}
+
+type rule struct {
+	kind     Kind
+	pattern  string
+	ipnet    *net.IPNet
+	port     uint16
+	outbound string
+}
+
+func (ru rule) matchesDomain(domain string) bool {
+	switch ru.kind {
+	case KindDomain:
+		return domain == ru.pattern
+	case KindDomainSuffix:
+		return domain == ru.pattern || strings.HasSuffix(domain, "."+ru.pattern)
+	case KindDomainKeyword:
+		return strings.Contains(domain, ru.pattern)
+	case KindMatch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (ru rule) matchesDestination(dest netip.AddrPort, domain string, hasDomain bool, geoip GeoIPResolver) bool {
+	switch ru.kind {
+	case KindDomain, KindDomainSuffix, KindDomainKeyword:
+		return hasDomain && ru.matchesDomain(domain)
+	case KindIPCIDR:
+		return ru.ipnet != nil && ru.ipnet.Contains(net.IP(dest.Addr().AsSlice()))
+	case KindDstPort:
+		return dest.Port() == ru.port
+	case KindGeoIP:
+		if geoip == nil {
+			return false
+		}
+		country, err := geoip.Country(dest.Addr())
+		return err == nil && strings.EqualFold(country, ru.pattern)
+	case KindMatch:
+		return true
+	default:
+		return false
+	}
+}
+
+// Router selects an Outbound per connection by evaluating Rules in the
+// order they were added - the first matching Rule wins, so a Rule of kind
+// MATCH (which always matches) should be added last, as a default.
+type Router struct {
+	mu        sync.RWMutex
+	rules     []rule
+	outbounds map[string]*Outbound
+	geoip     GeoIPResolver
+	domains   *domainCache
+}
+
+// NewRouter returns an empty Router. It matches nothing until
+// AddOutbound/AddRule (or LoadRulesYAML) configure it.
+func NewRouter() *Router {
+	return &Router{
+		outbounds: make(map[string]*Outbound),
+		domains:   newDomainCache(512),
+	}
+}
+
+// AddOutbound registers name as routable to server for DNS queries, with
+// splitMode ("none", "always", "retry", or "random") applied to port-443
+// destinations routed here.
+func (r *Router) AddOutbound(name string, server doh.DoHTransport, splitMode string) error {
+	if name == "" {
+		return errors.New("outbound name is required")
+	}
+	if server == nil {
+		return errors.New("server is required")
+	}
+	transportConfig, err := splitModeToTransportConfig(splitMode)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outbounds[name] = &Outbound{DoH: server, TransportConfig: transportConfig}
+	return nil
+}
+
+// splitModeToTransportConfig maps AddOutbound's splitMode names to an
+// internal/config transport config string.
+func splitModeToTransportConfig(mode string) (string, error) {
+	switch mode {
+	case "", SplitNone:
+		return "", nil
+	case SplitAlways:
+		return "split", nil
+	case SplitRetry:
+		return "splitretry", nil
+	case SplitRandom:
+		// internal/config/wrappers.go has no wrapper that splits a random
+		// subset of dials yet; alias to splitretry, the closest existing
+		// behavior, until one exists.
+		return "splitretry", nil
+	default:
+		return "", fmt.Errorf("unknown split mode %q", mode)
+	}
+}
+
+func (r *Router) hasOutbound(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.outbounds[name]
+	return ok
+}
+
+// AddRule appends a rule matching pattern (interpreted according to kind)
+// to outbound, which must already exist. Rules are evaluated in the order
+// they're added.
+func (r *Router) AddRule(kind, pattern, outbound string) error {
+	if !r.hasOutbound(outbound) {
+		return fmt.Errorf("unknown outbound %q: add it with AddOutbound first", outbound)
+	}
+
+	ru := rule{kind: Kind(kind), outbound: outbound}
+	switch ru.kind {
+	case KindDomain, KindDomainSuffix, KindDomainKeyword:
+		if pattern == "" {
+			return fmt.Errorf("%s rule requires a pattern", kind)
+		}
+		ru.pattern = strings.ToLower(pattern)
+	case KindIPCIDR:
+		_, ipnet, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid IP-CIDR pattern %q: %w", pattern, err)
+		}
+		ru.ipnet = ipnet
+	case KindGeoIP:
+		if pattern == "" {
+			return errors.New("GEOIP rule requires a country code pattern")
+		}
+		ru.pattern = strings.ToUpper(pattern)
+	case KindDstPort:
+		port, err := strconv.ParseUint(pattern, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid DST-PORT pattern %q: %w", pattern, err)
+		}
+		ru.port = uint16(port)
+	case KindMatch:
+		// no pattern to validate
+	default:
+		return fmt.Errorf("unknown rule kind %q", kind)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rules = append(r.rules, ru)
+	return nil
+}
+
+// MatchDNSQuery returns the Outbound whose rule matches a fake-DNS query
+// for domain, considering only DOMAIN/DOMAIN-SUFFIX/DOMAIN-KEYWORD/MATCH
+// rules - the query's answer (and so its destination IP) isn't known yet,
+// so IP-CIDR/GEOIP/DST-PORT rules can't apply here; see MatchDestination.
+func (r *Router) MatchDNSQuery(domain string) (server doh.DoHTransport, transportConfig string, ok bool) {
+	domain = normalizeDomain(domain)
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, ru := range r.rules {
+		if ru.matchesDomain(domain) {
+			if ob, ok := r.outbounds[ru.outbound]; ok {
+				return ob.DoH, ob.TransportConfig, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// MatchDestination returns the transport config an Outbound's rule selects
+// for dialing dest. Besides IP-CIDR/GEOIP/DST-PORT/MATCH rules, it also
+// considers DOMAIN/DOMAIN-SUFFIX/DOMAIN-KEYWORD rules against whatever
+// domain RecordDNSAnswer last associated with dest's address, so a rule
+// written against a domain still applies to the TCP connections a
+// resolved query leads to.
+func (r *Router) MatchDestination(dest netip.AddrPort) (transportConfig string, ok bool) {
+	domain, hasDomain := r.domains.lookup(dest.Addr())
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, ru := range r.rules {
+		if ru.matchesDestination(dest, domain, hasDomain, r.geoip) {
+			if ob, ok := r.outbounds[ru.outbound]; ok {
+				return ob.TransportConfig, true
+			}
+		}
+	}
+	return "", false
+}
+
+// RecordDNSAnswer records that domain resolved to addrs, so a later call to
+// MatchDestination with one of addrs can still apply domain-based rules.
+func (r *Router) RecordDNSAnswer(domain string, addrs []netip.Addr) {
+	r.domains.record(normalizeDomain(domain), addrs)
+}
+
+// SetGeoIPResolver installs the GeoIPResolver used to evaluate GEOIP
+// rules. Pass nil (the default) to make GEOIP rules never match.
+func (r *Router) SetGeoIPResolver(resolver GeoIPResolver) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.geoip = resolver
+}
+
+func normalizeDomain(domain string) string {
+	return strings.ToLower(strings.TrimSuffix(domain, "."))
+}
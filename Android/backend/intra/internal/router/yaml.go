@@ -0,0 +1,57 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rulesYAML is the schema LoadRulesYAML parses. It only describes rules -
+// outbounds wrap a live doh.DoHTransport, so they're Go objects and must
+// already have been registered with AddOutbound by name.
+type rulesYAML struct {
+	Rules []struct {
+		Kind     string `yaml:"kind"`
+		Pattern  string `yaml:"pattern"`
+		Outbound string `yaml:"outbound"`
+	} `yaml:"rules"`
+}
+
+// LoadRulesYAML appends the rules described by data, a small Clash-like
+// YAML document:
+//
+//	rules:
+//	  - kind: DOMAIN-SUFFIX
+//	    pattern: example.com
+//	    outbound: primary
+//	  - kind: MATCH
+//	    outbound: fallback
+//
+// Every referenced outbound must already exist (added via AddOutbound)
+// before this is called.
+func (r *Router) LoadRulesYAML(data []byte) error {
+	var doc rulesYAML
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("invalid rules YAML: %w", err)
+	}
+	for i, ru := range doc.Rules {
+		if err := r.AddRule(ru.Kind, ru.Pattern, ru.Outbound); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+
+	"github.com/Jigsaw-Code/outline-sdk/transport"
+)
+
+// handleConnect serves a CONNECT request: it dials addr through s.sd and, on
+// success, relays bytes between conn and the resulting transport.StreamConn
+// until either side is done.
+func (s *Server) handleConnect(ctx context.Context, conn net.Conn, addr string) {
+	dest, err := s.resolveDestination(ctx, addr)
+	if err != nil {
+		log.Printf("[error] SOCKS5 CONNECT: failed to resolve %v: %v\n", addr, err)
+		writeReply(conn, replyHostUnreachable, "0.0.0.0:0")
+		return
+	}
+
+	target, err := s.sd.Dial(ctx, dest.String())
+	if err != nil {
+		log.Printf("[error] SOCKS5 CONNECT: failed to dial %v: %v\n", dest, err)
+		writeReply(conn, replyGeneralFailure, "0.0.0.0:0")
+		return
+	}
+	defer target.Close()
+
+	if err := writeReply(conn, replySucceeded, target.LocalAddr().String()); err != nil {
+		log.Printf("[error] SOCKS5 CONNECT: failed to reply: %v\n", err)
+		return
+	}
+	relay(conn, target)
+}
+
+// relay copies bytes between a and b until both directions are done,
+// half-closing each side's write half as its source is exhausted so a
+// one-directional shutdown (e.g. an HTTP request with no body after the
+// headers) doesn't block the other direction.
+func relay(a net.Conn, b transport.StreamConn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(b, a)
+		b.CloseWrite()
+	}()
+
+	io.Copy(a, b)
+	if tcpConn, ok := a.(interface{ CloseWrite() error }); ok {
+		tcpConn.CloseWrite()
+	}
+	<-done
+}
@@ -0,0 +1,155 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package socks5 is an in-process SOCKS5 server (RFC 1928/1929) that
+// dispatches CONNECT through a doh.DoHStreamDialer and UDP ASSOCIATE
+// through a doh.DoHPacketProxy - the same two front doors the tun/lwIP
+// device uses - so a SOCKS5 client gets Intra's DNS interception and
+// port-443 splitting without going through Android's VpnService.
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+const version5 = 0x05
+
+// Authentication methods, as enumerated in
+// https://datatracker.ietf.org/doc/html/rfc1928#section-3.
+const (
+	methodNoAuth       = 0x00
+	methodUserPass     = 0x02
+	methodNoAcceptable = 0xFF
+)
+
+// userPassAuthVersion is the sub-negotiation version byte defined by
+// https://datatracker.ietf.org/doc/html/rfc1929#section-2.
+const userPassAuthVersion = 0x01
+
+// Commands, as enumerated in
+// https://datatracker.ietf.org/doc/html/rfc1928#section-4.
+const (
+	cmdConnect      = 0x01
+	cmdUDPAssociate = 0x03
+)
+
+// Address types, as enumerated in
+// https://datatracker.ietf.org/doc/html/rfc1928#section-5.
+const (
+	atypIPv4   = 0x01
+	atypDomain = 0x03
+	atypIPv6   = 0x04
+)
+
+// replyCode is the REP field of a SOCKS5 reply; see
+// https://datatracker.ietf.org/doc/html/rfc1928#section-6.
+type replyCode byte
+
+const (
+	replySucceeded           replyCode = 0x00
+	replyGeneralFailure      replyCode = 0x01
+	replyHostUnreachable     replyCode = 0x04
+	replyCommandNotSupported replyCode = 0x07
+	replyAddressNotSupported replyCode = 0x08
+)
+
+// readAddr reads a SOCKS5 address of the given type from r, as specified in
+// https://datatracker.ietf.org/doc/html/rfc1928#section-5, and returns it as
+// a "host:port" string. It is used for both the CONNECT/UDP ASSOCIATE
+// request address and the per-datagram destination address of a UDP
+// ASSOCIATE relay packet.
+func readAddr(r io.Reader, atyp byte) (string, error) {
+	var host string
+	switch atyp {
+	case atypIPv4:
+		b := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("failed to read IPv4 address: %w", err)
+		}
+		host = net.IP(b).String()
+	case atypIPv6:
+		b := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("failed to read IPv6 address: %w", err)
+		}
+		host = net.IP(b).String()
+	case atypDomain:
+		lenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(r, lenBuf); err != nil {
+			return "", fmt.Errorf("failed to read domain length: %w", err)
+		}
+		b := make([]byte, lenBuf[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("failed to read domain name: %w", err)
+		}
+		host = string(b)
+	default:
+		return "", fmt.Errorf("unsupported address type %d", atyp)
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err := io.ReadFull(r, portBuf); err != nil {
+		return "", fmt.Errorf("failed to read port: %w", err)
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBuf)))), nil
+}
+
+// appendSOCKS5Addr appends addr ("host:port") to b in SOCKS5 wire format,
+// as specified in https://datatracker.ietf.org/doc/html/rfc1928#section-5.
+func appendSOCKS5Addr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %q: %w", addr, err)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() {
+			b = append(b, atypIPv4)
+		} else {
+			b = append(b, atypIPv6)
+		}
+		b = append(b, ip.AsSlice()...)
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("domain name length = %v is over 255", len(host))
+		}
+		b = append(b, atypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// writeReply writes a SOCKS5 reply with the given REP code and bound
+// address. A bound address that can't be encoded (e.g. because the dial
+// never got far enough to have one) falls back to 0.0.0.0:0, since the
+// client only looks at it when code is replySucceeded.
+func writeReply(w io.Writer, code replyCode, boundAddr string) error {
+	b := []byte{version5, byte(code), 0x00}
+	if reply, err := appendSOCKS5Addr(b, boundAddr); err == nil {
+		b = reply
+	} else {
+		b = append(b, atypIPv4, 0, 0, 0, 0, 0, 0)
+	}
+	_, err := w.Write(b)
+	return err
+}
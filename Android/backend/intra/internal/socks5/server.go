@@ -0,0 +1,290 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/doh"
+	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/protect"
+)
+
+// Credentials is a SOCKS5 username/password pair, checked per RFC 1929. A
+// nil *Credentials on Server (the default) means clients may authenticate
+// with SOCKS5's no-auth method instead.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Server is an in-process SOCKS5 server. See the package doc comment for
+// how it dispatches CONNECT and UDP ASSOCIATE.
+type Server struct {
+	sd          doh.DoHStreamDialer
+	pp          doh.DoHPacketProxy
+	fakeDNSAddr netip.AddrPort
+	// dialer resolves domain-name destinations to an IP before handing them
+	// to sd/pp, which only accept "ip:port" raddrs. It's built from the
+	// same protector as sd/pp, so resolution itself doesn't leak outside
+	// the VPN.
+	dialer      *net.Dialer
+	credentials atomic.Pointer[Credentials]
+
+	mu       sync.Mutex
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+// NewServer creates a Server that dispatches CONNECT through sd and UDP
+// ASSOCIATE through pp - normally an IntraDevice's own sd/pp, so a SOCKS5
+// client gets identical behavior to traffic arriving over the tun device.
+// fakeDNSAddr is the sentinel address sd/pp intercept as a DoH query
+// (IntraDevice's own fakeDNS address); protector exempts the server's
+// domain-resolution sockets from the VPN the same way SocketProtector does
+// elsewhere. The UDP ASSOCIATE relay socket is opened without it.
+func NewServer(sd doh.DoHStreamDialer, pp doh.DoHPacketProxy, fakeDNSAddr netip.AddrPort, protector doh.Protector) *Server {
+	return &Server{
+		sd:          sd,
+		pp:          pp,
+		fakeDNSAddr: fakeDNSAddr,
+		dialer:      protect.MakeDialer(protector),
+	}
+}
+
+// SetCredentials configures username/password authentication (RFC 1929).
+// Passing nil reverts to allowing the no-auth method.
+func (s *Server) SetCredentials(creds *Credentials) {
+	s.credentials.Store(creds)
+}
+
+// Start begins accepting SOCKS5 connections on listenAddr. It returns once
+// the listener is open; connections are served on background goroutines
+// until Stop is called. Calling Start while already running is an error.
+func (s *Server) Start(listenAddr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener != nil {
+		return errors.New("SOCKS5 server is already running")
+	}
+
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %v: %w", listenAddr, err)
+	}
+	s.listener = ln
+
+	s.wg.Add(1)
+	go s.acceptLoop(ln)
+	log.Printf("[info] SOCKS5 server listening on %v\n", ln.Addr())
+	return nil
+}
+
+// Stop closes the listener, if running, and waits for the accept loop to
+// exit. Connections already accepted are left to finish on their own.
+func (s *Server) Stop() error {
+	s.mu.Lock()
+	ln := s.listener
+	s.listener = nil
+	s.mu.Unlock()
+	if ln == nil {
+		return nil
+	}
+
+	err := ln.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) acceptLoop(ln net.Listener) {
+	defer s.wg.Done()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("[info] SOCKS5 listener closed: %v\n", err)
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if err := s.handshake(r, conn); err != nil {
+		log.Printf("[error] SOCKS5 handshake failed: %v\n", err)
+		return
+	}
+
+	cmd, addr, err := readRequest(r)
+	if err != nil {
+		log.Printf("[error] SOCKS5 request failed: %v\n", err)
+		writeReply(conn, replyGeneralFailure, "0.0.0.0:0")
+		return
+	}
+
+	switch cmd {
+	case cmdConnect:
+		s.handleConnect(context.Background(), conn, addr)
+	case cmdUDPAssociate:
+		s.handleUDPAssociate(conn, addr)
+	default:
+		log.Printf("[error] SOCKS5 request: unsupported command %d\n", cmd)
+		writeReply(conn, replyCommandNotSupported, "0.0.0.0:0")
+	}
+}
+
+// handshake performs the SOCKS5 method negotiation (RFC 1928 section 3),
+// then the username/password sub-negotiation (RFC 1929) if that's the
+// method selected.
+func (s *Server) handshake(r *bufio.Reader, w io.Writer) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed to read greeting: %w", err)
+	}
+	if header[0] != version5 {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return fmt.Errorf("failed to read auth methods: %w", err)
+	}
+
+	creds := s.credentials.Load()
+	selected := byte(methodNoAcceptable)
+	for _, m := range methods {
+		if creds != nil && m == methodUserPass {
+			selected = methodUserPass
+			break
+		}
+		if creds == nil && m == methodNoAuth {
+			selected = methodNoAuth
+			break
+		}
+	}
+	if _, err := w.Write([]byte{version5, selected}); err != nil {
+		return fmt.Errorf("failed to reply to greeting: %w", err)
+	}
+	if selected == methodNoAcceptable {
+		return errors.New("client offered no acceptable auth method")
+	}
+	if selected == methodUserPass {
+		return s.authenticate(r, w, creds)
+	}
+	return nil
+}
+
+// authenticate implements the username/password sub-negotiation specified
+// in https://datatracker.ietf.org/doc/html/rfc1929#section-2.
+func (s *Server) authenticate(r *bufio.Reader, w io.Writer, creds *Credentials) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("failed to read auth request: %w", err)
+	}
+	if header[0] != userPassAuthVersion {
+		return fmt.Errorf("unsupported auth version %d", header[0])
+	}
+
+	username := make([]byte, header[1])
+	if _, err := io.ReadFull(r, username); err != nil {
+		return fmt.Errorf("failed to read username: %w", err)
+	}
+	passLen := make([]byte, 1)
+	if _, err := io.ReadFull(r, passLen); err != nil {
+		return fmt.Errorf("failed to read password length: %w", err)
+	}
+	password := make([]byte, passLen[0])
+	if _, err := io.ReadFull(r, password); err != nil {
+		return fmt.Errorf("failed to read password: %w", err)
+	}
+
+	ok := string(username) == creds.Username && string(password) == creds.Password
+	status := byte(0x00)
+	if !ok {
+		status = 0x01
+	}
+	if _, err := w.Write([]byte{userPassAuthVersion, status}); err != nil {
+		return fmt.Errorf("failed to reply to auth request: %w", err)
+	}
+	if !ok {
+		return errors.New("client sent invalid SOCKS5 credentials")
+	}
+	return nil
+}
+
+// readRequest reads a CONNECT or UDP ASSOCIATE request, as specified in
+// https://datatracker.ietf.org/doc/html/rfc1928#section-4.
+func readRequest(r *bufio.Reader) (cmd byte, addr string, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return 0, "", fmt.Errorf("failed to read request header: %w", err)
+	}
+	if header[0] != version5 {
+		return 0, "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	if addr, err = readAddr(r, header[3]); err != nil {
+		return 0, "", err
+	}
+	return header[1], addr, nil
+}
+
+// resolveDestination turns addr ("host:port", where host may be a domain
+// name) into a netip.AddrPort usable by sd.Dial and pp's
+// PacketRequestSender.WriteTo, neither of which accept domain names. DNS
+// lookups - identified by port 53, the same signal Intra's tun/lwIP path
+// uses to recognize a client's own DNS query - are rewritten to the
+// fake-DNS sentinel address, so they're intercepted by the DoH transport
+// instead of actually reaching whatever the client dialed.
+func (s *Server) resolveDestination(ctx context.Context, addr string) (netip.AddrPort, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if portStr == "53" {
+		return s.fakeDNSAddr, nil
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid port %q: %w", portStr, err)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return netip.AddrPortFrom(ip.Unmap(), uint16(port)), nil
+	}
+
+	resolver := s.dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("failed to resolve %q: %w", host, err)
+	}
+	if len(ips) == 0 {
+		return netip.AddrPort{}, fmt.Errorf("no addresses found for %q", host)
+	}
+	return netip.AddrPortFrom(ips[0].Unmap(), uint16(port)), nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package socks5
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"github.com/Jigsaw-Code/outline-sdk/network"
+)
+
+// handleUDPAssociate serves a UDP ASSOCIATE request (RFC 1928 section 4):
+// it opens a relay socket for the client's UDP datagrams, registers a
+// session with s.pp, and relays until conn (the control connection) is
+// closed, per the RFC's "association is ... terminated when the TCP
+// connection ... is closed" rule.
+func (s *Server) handleUDPAssociate(conn net.Conn, _ string) {
+	relayConn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		log.Printf("[error] SOCKS5 UDP ASSOCIATE: failed to open relay socket: %v\n", err)
+		writeReply(conn, replyGeneralFailure, "0.0.0.0:0")
+		return
+	}
+	defer relayConn.Close()
+
+	resp := &udpResponseReceiver{relayConn: relayConn}
+	sender, err := s.pp.NewSession(resp)
+	if err != nil {
+		log.Printf("[error] SOCKS5 UDP ASSOCIATE: failed to create session: %v\n", err)
+		writeReply(conn, replyGeneralFailure, "0.0.0.0:0")
+		return
+	}
+	defer sender.Close()
+
+	if err := writeReply(conn, replySucceeded, relayConn.LocalAddr().String()); err != nil {
+		log.Printf("[error] SOCKS5 UDP ASSOCIATE: failed to reply: %v\n", err)
+		return
+	}
+
+	// The control connection carries no further SOCKS5 traffic; its only
+	// remaining purpose is to signal, by closing, that the client is done
+	// with the association. Reading it to EOF and tearing the relay down
+	// unblocks relayConn.ReadFromUDP below.
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				relayConn.Close()
+				return
+			}
+		}
+	}()
+
+	ctx := context.Background()
+	buf := make([]byte, 64*1024)
+	for {
+		n, clientAddr, err := relayConn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		resp.clientAddr.Store(clientAddr)
+
+		hostport, payload, err := parseUDPDatagram(buf[:n])
+		if err != nil {
+			log.Printf("[error] SOCKS5 UDP ASSOCIATE: malformed datagram from %v: %v\n", clientAddr, err)
+			continue
+		}
+		dest, err := s.resolveDestination(ctx, hostport)
+		if err != nil {
+			log.Printf("[error] SOCKS5 UDP ASSOCIATE: failed to resolve %v: %v\n", hostport, err)
+			continue
+		}
+		if _, err := sender.WriteTo(payload, dest); err != nil {
+			log.Printf("[error] SOCKS5 UDP ASSOCIATE: failed to send to %v: %v\n", dest, err)
+		}
+	}
+}
+
+// udpResponseReceiver implements network.PacketResponseReceiver, wrapping
+// each response in SOCKS5 UDP request header format (RFC 1928 section 7)
+// and writing it to the most recently seen client address - a SOCKS5 UDP
+// association has exactly one client peer, but that peer's address isn't
+// known until its first datagram arrives, so it's recorded rather than
+// passed in up front.
+type udpResponseReceiver struct {
+	relayConn  *net.UDPConn
+	clientAddr atomic.Pointer[net.UDPAddr]
+}
+
+var _ network.PacketResponseReceiver = (*udpResponseReceiver)(nil)
+
+// WriteFrom implements network.PacketResponseReceiver.WriteFrom.
+func (r *udpResponseReceiver) WriteFrom(p []byte, source net.Addr) (int, error) {
+	clientAddr := r.clientAddr.Load()
+	if clientAddr == nil {
+		return 0, errors.New("no client datagram received yet")
+	}
+	datagram, err := wrapUDPDatagram(source, p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := r.relayConn.WriteToUDP(datagram, clientAddr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements network.PacketResponseReceiver.Close.
+func (r *udpResponseReceiver) Close() error {
+	return r.relayConn.Close()
+}
+
+// parseUDPDatagram parses a SOCKS5 UDP request header (RFC 1928 section 7)
+// off the front of a datagram the client sent to the relay socket,
+// returning the embedded destination and the remaining payload.
+// Fragmentation (FRAG != 0) isn't supported, matching most SOCKS5 clients'
+// own expectations.
+func parseUDPDatagram(b []byte) (hostport string, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("datagram too short")
+	}
+	if b[2] != 0 {
+		return "", nil, fmt.Errorf("unsupported fragment number %d", b[2])
+	}
+	r := newByteReader(b[4:])
+	hostport, err = readAddr(r, b[3])
+	if err != nil {
+		return "", nil, err
+	}
+	return hostport, r.rest(), nil
+}
+
+// wrapUDPDatagram prepends a SOCKS5 UDP request header identifying source
+// to payload, as required of every datagram the relay sends back to the
+// client (RFC 1928 section 7).
+func wrapUDPDatagram(source net.Addr, payload []byte) ([]byte, error) {
+	b := []byte{0x00, 0x00, 0x00}
+	b, err := appendSOCKS5Addr(b, source.String())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode source address %v: %w", source, err)
+	}
+	return append(b, payload...), nil
+}
+
+// byteReader adapts a byte slice to the io.Reader readAddr expects, while
+// exposing the unconsumed remainder (the datagram payload) once readAddr
+// is done with the address.
+type byteReader struct {
+	b []byte
+}
+
+func newByteReader(b []byte) *byteReader {
+	return &byteReader{b: b}
+}
+
+func (r *byteReader) Read(p []byte) (int, error) {
+	n := copy(p, r.b)
+	r.b = r.b[n:]
+	if n == 0 && len(p) > 0 {
+		return 0, errors.New("unexpected EOF")
+	}
+	return n, nil
+}
+
+func (r *byteReader) rest() []byte {
+	return r.b
+}
@@ -15,6 +15,7 @@
 package intra
 
 import (
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/classify"
 	intraLegacy "github.com/Jigsaw-Code/outline-go-tun2socks/intra"
 	dohLegacy "github.com/Jigsaw-Code/outline-go-tun2socks/intra/doh"
 	"github.com/Jigsaw-Code/outline-go-tun2socks/intra/split"
@@ -30,6 +31,16 @@ type EventListener interface {
 	OnResponse(DoHToken, DoHQueryStats)
 }
 
+// ClassifierListener is an optional extension of [EventListener]. Application
+// code may additionally implement it to be notified, alongside
+// OnTCPSocketClosed, of the flow's classified L7 protocol (classification
+// normally completes within the first few KB of a flow, well before it
+// closes). Intra checks for this interface with a type assertion, so
+// existing EventListener implementations keep working unchanged.
+type ClassifierListener interface {
+	OnClassified(TCPSocketStats)
+}
+
 // eventListenerAdapter is an bridge connecting EventListener and the listener types defined in legacy code.
 // We cannot reuse EventListener because we redefined all function parameter types, which is inconsistent with the
 // original types.
@@ -38,6 +49,11 @@ type eventListenerAdapter struct {
 }
 
 func (e eventListenerAdapter) OnTCPSocketClosed(s *intraLegacy.TCPSocketSummary) {
+	if cl, ok := e.listener.(ClassifierListener); ok {
+		if _, done := classify.Lookup(s); done {
+			cl.OnClassified(tcpSocketStatsAdapter{s})
+		}
+	}
 	e.listener.OnTCPSocketClosed(tcpSocketStatsAdapter{s})
 }
 
@@ -64,12 +80,15 @@ type TCPRetryStats interface {
 }
 
 type TCPSocketStats interface {
-	GetDownloadBytes() int64 // Total bytes downloaded.
-	GetUploadBytes() int64   // Total bytes uploaded.
-	GetDuration() int32      // Duration in seconds.
-	GetServerPort() int16    // The server port.  All values except 80, 443, and 0 are set to -1.
-	GetSynack() int32        // TCP handshake latency (ms)
-	GetRetry() TCPRetryStats // Retry is non-nil if retry was possible.  Retry.Split is non-zero if a retry occurred.
+	GetDownloadBytes() int64  // Total bytes downloaded.
+	GetUploadBytes() int64    // Total bytes uploaded.
+	GetDuration() int32       // Duration in seconds.
+	GetServerPort() int16     // The server port.  All values except 80, 443, and 0 are set to -1.
+	GetSynack() int32         // TCP handshake latency (ms)
+	GetRetry() TCPRetryStats  // Retry is non-nil if retry was possible.  Retry.Split is non-zero if a retry occurred.
+	GetProtocol() string      // Sniffed L7 protocol, e.g. "tls", "http", "ssh", "unknown".
+	GetTLSServerName() string // TLS SNI, if GetProtocol() == "tls" and it was present.
+	GetTLSALPN() string       // TLS ALPN, if GetProtocol() == "tls" and it was present.
 }
 
 type tcpRetryStatsAdapter struct {
@@ -93,12 +112,28 @@ func (s tcpSocketStatsAdapter) GetServerPort() int16    { return s.ServerPort }
 func (s tcpSocketStatsAdapter) GetSynack() int32        { return s.Synack }
 func (s tcpSocketStatsAdapter) GetRetry() TCPRetryStats { return tcpRetryStatsAdapter{s.Retry} }
 
+func (s tcpSocketStatsAdapter) GetProtocol() string {
+	r, _ := classify.Lookup(s.TCPSocketSummary)
+	return r.Protocol
+}
+
+func (s tcpSocketStatsAdapter) GetTLSServerName() string {
+	r, _ := classify.Lookup(s.TCPSocketSummary)
+	return r.TLSServerName
+}
+
+func (s tcpSocketStatsAdapter) GetTLSALPN() string {
+	r, _ := classify.Lookup(s.TCPSocketSummary)
+	return r.TLSALPN
+}
+
 ////////// UDPListener type redefinitions
 
 type UDPSocketStats interface {
 	GetUploadBytes() int64   // Amount uploaded (bytes)
 	GetDownloadBytes() int64 // Amount downloaded (bytes)
 	GetDuration() int32      // How long the socket was open (seconds)
+	GetProtocol() string     // Sniffed L7 protocol, e.g. "quic-initial", "unknown".
 }
 
 type udpSocketStatsAdapter struct {
@@ -109,6 +144,11 @@ func (s udpSocketStatsAdapter) GetUploadBytes() int64   { return s.UploadBytes }
 func (s udpSocketStatsAdapter) GetDownloadBytes() int64 { return s.DownloadBytes }
 func (s udpSocketStatsAdapter) GetDuration() int32      { return s.Duration }
 
+func (s udpSocketStatsAdapter) GetProtocol() string {
+	r, _ := classify.Lookup(s.UDPSocketSummary)
+	return r.Protocol
+}
+
 ////////// DoHListener type redefinitions
 
 const (
@@ -0,0 +1,42 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"io"
+
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/metrics"
+)
+
+// MetricsSnapshot is a point-in-time copy of Intra's aggregated traffic and
+// latency counters, across every TCP session this device has handled. See
+// [IntraDevice.Metrics].
+type MetricsSnapshot = metrics.Snapshot
+
+// Metrics returns a snapshot of Intra's aggregated traffic and latency
+// counters: bytes up/down, session/retry/retry-timeout/fragmented counts,
+// a SNI histogram, and dial-RTT/first-byte latency histograms. Unlike
+// Flows, this never shrinks back to zero as sessions close - it is a
+// running total since the device was created.
+func (d *IntraDevice) Metrics() MetricsSnapshot {
+	return d.metrics.Snapshot()
+}
+
+// ExposeMetrics writes the same counters as Metrics in Prometheus text
+// exposition format, for a developer running the backend outside Android
+// (e.g. under `go run` against a local tunnel) to scrape directly.
+func (d *IntraDevice) ExposeMetrics(w io.Writer) error {
+	return d.metrics.Expose(w)
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package intra
+
+import (
+	"errors"
+
+	"github.com/Jigsaw-Code/Intra/Android/backend/intra/internal/router"
+)
+
+// Router lets the app split traffic across multiple DoHServers and
+// port-443 dial strategies using Clash-style rules (DOMAIN,
+// DOMAIN-SUFFIX, DOMAIN-KEYWORD, IP-CIDR, GEOIP, DST-PORT, MATCH),
+// instead of every connection going through a device's single configured
+// DoH server and transport config. Build one with NewRouter, configure it
+// with AddOutbound/AddRule or LoadRulesYAML, then hand it to
+// IntraDevice.SetRouter.
+type Router struct {
+	r *router.Router
+}
+
+// NewRouter returns an empty Router. It matches nothing - and so changes
+// no behavior - until AddOutbound/AddRule/LoadRulesYAML configure it.
+func NewRouter() *Router {
+	return &Router{r: router.NewRouter()}
+}
+
+// AddOutbound registers name as a destination rules can route to: a DNS
+// query routed here is answered by server, and a port-443 connection
+// routed here is dialed using splitMode ("none", "always", "retry", or
+// "random").
+func (ro *Router) AddOutbound(name string, server *DoHServer, splitMode string) error {
+	if server == nil {
+		return errors.New("server is required")
+	}
+	return ro.r.AddOutbound(name, server.t, splitMode)
+}
+
+// AddRule appends a rule to the end of the rule list: kind is one of
+// DOMAIN, DOMAIN-SUFFIX, DOMAIN-KEYWORD, IP-CIDR, GEOIP, DST-PORT, or
+// MATCH; pattern is interpreted according to kind (e.g. a CIDR for
+// IP-CIDR, a country code for GEOIP); outbound must already have been
+// added with AddOutbound. Rules are evaluated in the order they're added,
+// so a MATCH rule (which always matches) should be added last, as a
+// default.
+func (ro *Router) AddRule(kind, pattern, outbound string) error {
+	return ro.r.AddRule(kind, pattern, outbound)
+}
+
+// LoadRulesYAML appends the rules described by a small YAML document; see
+// internal/router's LoadRulesYAML for its schema.
+func (ro *Router) LoadRulesYAML(data []byte) error {
+	return ro.r.LoadRulesYAML(data)
+}